@@ -0,0 +1,130 @@
+package filedrop
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Max-age used for files without store time limit.
+const maxCacheAge = 365 * 24 * time.Hour
+
+// fileETag returns strong entity tag for file representation.
+func fileETag(info FileInfo, encoded bool) string {
+	if info.SHA256 == "" {
+		// Uploaded by older version, but contents never changes anyway.
+		return `"` + info.UUID + `"`
+	}
+	if encoded {
+		// Encoded representation is different, so it needs different tag.
+		return `"` + info.SHA256 + "-" + info.compression + `"`
+	}
+	return `"` + info.SHA256 + `"`
+}
+
+// cacheControl returns Cache-Control header value for file.
+//
+// Contents never change but file can be accessed only while it is
+// stored. Files with limited uses or restricted access should not be
+// stored in shared caches, since cache would bypass these checks.
+func (s *Server) cacheControl(info FileInfo, now time.Time) string {
+	scope := "public"
+	if info.MaxUses != 0 || info.passwordHash != "" || s.Conf.DownloadAuth.Callback != nil || s.Conf.DownloadAuth.ClientCert {
+		scope = "private"
+	}
+
+	maxAge := maxCacheAge
+	if !info.StoreUntil.IsZero() {
+		left := info.StoreUntil.Sub(now)
+		if left < 0 {
+			left = 0
+		}
+		if left < maxAge {
+			maxAge = left
+		}
+	}
+	return scope + ", max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10) + ", immutable"
+}
+
+// setFileHeaders sets representation and caching headers for file.
+// fileName is a name from URL (may be empty).
+func (s *Server) setFileHeaders(w http.ResponseWriter, info FileInfo, fileName string, encoded bool) {
+	if info.compression != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if encoded {
+			w.Header().Set("Content-Encoding", info.compression)
+		}
+	}
+	w.Header().Set("Content-Type", s.Conf.ContentTypes.servedContentType(info.ContentType))
+	w.Header().Set("Content-Disposition", s.Conf.ContentTypes.contentDisposition(info.ContentType, fileName))
+
+	w.Header().Set("ETag", fileETag(info, encoded))
+	if info.SHA256 != "" && !encoded {
+		// Digests of original contents can't be used for encoded
+		// representation.
+		if rawHash, err := hex.DecodeString(info.SHA256); err == nil {
+			b64Hash := base64.StdEncoding.EncodeToString(rawHash)
+			w.Header().Set("Repr-Digest", "sha-256=:"+b64Hash+":")
+			// Obsolete RFC 3230 header, still used by some clients.
+			w.Header().Set("Digest", "SHA-256="+b64Hash)
+		}
+	}
+	if !info.CreatedAt.IsZero() {
+		w.Header().Set("Last-Modified", info.CreatedAt.UTC().Format(http.TimeFormat))
+	}
+
+	now := time.Now()
+	w.Header().Set("Cache-Control", s.cacheControl(info, now))
+	if !info.StoreUntil.IsZero() {
+		w.Header().Set("Expires", info.StoreUntil.UTC().Format(http.TimeFormat))
+	}
+}
+
+// etagMatches implements weak comparison used for If-None-Match.
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified checks If-None-Match and If-Modified-Since request headers.
+func notModified(r *http.Request, etag string, modtime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		// If-Modified-Since is ignored if If-None-Match is present.
+		return etagMatches(inm, etag)
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || modtime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	return !modtime.Truncate(time.Second).After(t)
+}
+
+// writeNotModified writes 304 response, headers should be already set
+// by setFileHeaders.
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Encoding")
+	delete(h, "Repr-Digest")
+	delete(h, "Digest")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// isUsedUp checks whether file can't be downloaded anymore and will be
+// removed on next access.
+func isUsedUp(info FileInfo, now time.Time) bool {
+	return isExpired(info, now) || (info.MaxUses != 0 && info.Uses >= info.MaxUses)
+}
@@ -0,0 +1,149 @@
+package filedrop_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/filedrop"
+)
+
+func maxAge(t *testing.T, cacheControl string) int {
+	t.Helper()
+
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if strings.HasPrefix(directive, "max-age=") {
+			age, err := strconv.Atoi(directive[len("max-age="):])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return age
+		}
+	}
+	t.Fatal("no max-age in Cache-Control:", cacheControl)
+	return 0
+}
+
+func TestConditionalRequests(t *testing.T) {
+	conf := filedrop.Default
+	conf.Limits.MaxUses = 2
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+
+	resp, _ := getWithHeader(t, c, url, "Accept", "*/*")
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+		t.Fatal("Not a strong ETag:", etag)
+	}
+	modtime, err := http.ParseTime(lastModified)
+	if err != nil {
+		t.Fatal("Invalid Last-Modified:", lastModified)
+	}
+	if time.Since(modtime) > time.Minute {
+		t.Error("Last-Modified is not an upload time:", lastModified)
+	}
+
+	t.Run("If-None-Match", func(t *testing.T) {
+		resp, body := getWithHeader(t, c, url, "If-None-Match", etag)
+		if resp.StatusCode != http.StatusNotModified {
+			t.Fatal("GET: HTTP", resp.StatusCode, resp.Status)
+		}
+		if len(body) != 0 {
+			t.Error("Body in 304 response")
+		}
+		if resp.Header.Get("ETag") != etag {
+			t.Error("ETag mismatch in 304 response:", resp.Header.Get("ETag"))
+		}
+	})
+	t.Run("If-Modified-Since", func(t *testing.T) {
+		resp, _ := getWithHeader(t, c, url, "If-Modified-Since", lastModified)
+		if resp.StatusCode != http.StatusNotModified {
+			t.Fatal("GET: HTTP", resp.StatusCode, resp.Status)
+		}
+	})
+
+	// Conditional requests were not counted.
+	if uses := fileUses(t, serv, url); uses != 1 {
+		t.Fatal("Uses count is", uses, "but should be 1")
+	}
+
+	t.Run("If-None-Match with other tag", func(t *testing.T) {
+		resp, body := getWithHeader(t, c, url, "If-None-Match", `"other"`)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("GET: HTTP", resp.StatusCode, resp.Status)
+		}
+		if string(body) != file {
+			t.Error("Contents mismatch")
+		}
+	})
+
+	t.Run("used up", func(t *testing.T) {
+		resp, _ := getWithHeader(t, c, url, "If-None-Match", etag)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatal("GET: HTTP", resp.StatusCode, resp.Status)
+		}
+	})
+}
+
+func TestCacheControl(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	t.Run("unlimited", func(t *testing.T) {
+		url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+		resp, _ := getWithHeader(t, c, url, "Accept", "*/*")
+		cacheControl := resp.Header.Get("Cache-Control")
+		if !strings.HasPrefix(cacheControl, "public,") || !strings.Contains(cacheControl, "immutable") {
+			t.Error("Wrong Cache-Control:", cacheControl)
+		}
+		if age := maxAge(t, cacheControl); age != 365*24*60*60 {
+			t.Error("Wrong max-age:", age)
+		}
+		if resp.Header.Get("Expires") != "" {
+			t.Error("Expires set for file without time limit")
+		}
+	})
+	t.Run("store-secs", func(t *testing.T) {
+		url := string(doPOST(t, c, ts.URL+"/filedrop?store-secs=60", "text/plain", strings.NewReader(file)))
+		resp, _ := getWithHeader(t, c, url, "Accept", "*/*")
+		if age := maxAge(t, resp.Header.Get("Cache-Control")); age > 60 || age < 55 {
+			t.Error("Wrong max-age:", age)
+		}
+		expires, err := http.ParseTime(resp.Header.Get("Expires"))
+		if err != nil {
+			t.Fatal("Invalid Expires:", resp.Header.Get("Expires"))
+		}
+		if left := time.Until(expires); left > time.Minute || left < 55*time.Second {
+			t.Error("Wrong Expires:", resp.Header.Get("Expires"))
+		}
+	})
+}
+
+func TestCacheControlMaxUses(t *testing.T) {
+	conf := filedrop.Default
+	conf.Limits.MaxUses = 5
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	resp, _ := getWithHeader(t, c, url, "Accept", "*/*")
+	if cacheControl := resp.Header.Get("Cache-Control"); !strings.HasPrefix(cacheControl, "private,") {
+		t.Error("Wrong Cache-Control:", cacheControl)
+	}
+}
@@ -0,0 +1,227 @@
+package filedrop
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var defaultCompressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/xml",
+	"application/javascript",
+	"application/x-ndjson",
+	"image/svg+xml",
+}
+
+// maxMinSize limits CompressionConfig.MinSize, that much bytes are
+// buffered for each compressible upload.
+const maxMinSize = 1 << 20
+
+// Enabled reports whether compression at rest is configured.
+func (c CompressionConfig) Enabled() bool {
+	return c.Algorithm != ""
+}
+
+func (c CompressionConfig) validate() error {
+	switch c.Algorithm {
+	case "", CompressionZstd:
+	case CompressionGzip:
+		if c.Level < gzip.HuffmanOnly || c.Level > gzip.BestCompression {
+			return errors.New("compression: invalid gzip level: " + strconv.Itoa(c.Level))
+		}
+	default:
+		return errors.New("unknown compression algorithm: " + c.Algorithm)
+	}
+	if c.MinSize < 0 {
+		return errors.New("compression: min_size can't be negative")
+	}
+	if c.MinSize > maxMinSize {
+		return errors.New("compression: min_size can't be larger than 1 MiB")
+	}
+	return nil
+}
+
+// compressible checks whether files with specified content type should
+// be compressed.
+func (c CompressionConfig) compressible(contentType string) bool {
+	types := c.ContentTypes
+	if len(types) == 0 {
+		types = defaultCompressibleTypes
+	}
+	return matchContentType(types, contentType)
+}
+
+func newCompressor(w io.Writer, algorithm string, level int) (io.WriteCloser, error) {
+	switch algorithm {
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		zlevel := zstd.SpeedDefault
+		if level != 0 {
+			zlevel = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zlevel))
+	default:
+		return nil, errors.New("unknown compression algorithm: " + algorithm)
+	}
+}
+
+func newDecompressor(r io.Reader, algorithm string) (io.ReadCloser, error) {
+	switch algorithm {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	default:
+		return nil, errors.New("unknown compression algorithm: " + algorithm)
+	}
+}
+
+// decompressingReader implements seeking on top of compressed stream.
+//
+// Seeking forward is implemented by discarding decompressed data, seeking
+// backward restarts decompression, so it is efficient only for
+// sequential reads and single range requests (the usual case).
+type decompressingReader struct {
+	src       readSeekCloser
+	algorithm string
+	size      int64
+
+	dec       io.ReadCloser
+	pos       int64
+	streamPos int64
+}
+
+// newDecompressingReader returns reader that decompresses src, size is a
+// size of decompressed data. Closing reader closes src.
+func newDecompressingReader(src readSeekCloser, algorithm string, size int64) *decompressingReader {
+	return &decompressingReader{
+		src:       src,
+		algorithm: algorithm,
+		size:      size,
+	}
+}
+
+func (dr *decompressingReader) restart() error {
+	if dr.dec != nil {
+		dr.dec.Close()
+		dr.dec = nil
+	}
+	if _, err := dr.src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	dec, err := newDecompressor(dr.src, dr.algorithm)
+	if err != nil {
+		return errors.Wrap(err, "decompressor init")
+	}
+	dr.dec = dec
+	dr.streamPos = 0
+	return nil
+}
+
+func (dr *decompressingReader) Read(b []byte) (int, error) {
+	if dr.pos >= dr.size {
+		return 0, io.EOF
+	}
+
+	if dr.dec == nil || dr.streamPos > dr.pos {
+		if err := dr.restart(); err != nil {
+			return 0, err
+		}
+	}
+	if dr.streamPos < dr.pos {
+		skipped, err := io.CopyN(ioutil.Discard, dr.dec, dr.pos-dr.streamPos)
+		dr.streamPos += skipped
+		if err != nil {
+			return 0, errors.Wrap(err, "decompress")
+		}
+	}
+
+	if int64(len(b)) > dr.size-dr.pos {
+		b = b[:dr.size-dr.pos]
+	}
+	n, err := dr.dec.Read(b)
+	dr.pos += int64(n)
+	dr.streamPos += int64(n)
+	if err == io.EOF && dr.pos < dr.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (dr *decompressingReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = dr.pos + offset
+	case io.SeekEnd:
+		pos = dr.size + offset
+	default:
+		return dr.pos, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return dr.pos, errors.New("negative position")
+	}
+	dr.pos = pos
+	return pos, nil
+}
+
+func (dr *decompressingReader) Close() error {
+	if dr.dec != nil {
+		dr.dec.Close()
+	}
+	return dr.src.Close()
+}
+
+// acceptsEncoding checks whether Accept-Encoding header value allows
+// specified content coding.
+func acceptsEncoding(header, encoding string) bool {
+	explicit, wildcard := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != encoding && coding != "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					quality = q
+				}
+			}
+		}
+		if coding == encoding {
+			explicit = quality
+		} else {
+			wildcard = quality
+		}
+	}
+	if explicit >= 0 {
+		return explicit > 0
+	}
+	return wildcard > 0
+}
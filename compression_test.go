@@ -0,0 +1,225 @@
+package filedrop_test
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/filedrop"
+	"github.com/klauspost/compress/zstd"
+)
+
+func storedSize(t *testing.T, serv *filedrop.Server, fileUUID string) int64 {
+	t.Helper()
+
+	stat, err := os.Stat(filepath.Join(serv.Conf.StorageDir, fileUUID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stat.Size()
+}
+
+func getWithHeader(t *testing.T, c *http.Client, url, key, value string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(key, value)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestCompression(t *testing.T) {
+	for _, algorithm := range []string{filedrop.CompressionGzip, filedrop.CompressionZstd} {
+		algorithm := algorithm
+		t.Run(algorithm, func(t *testing.T) {
+			conf := filedrop.Default
+			conf.Compression.Algorithm = algorithm
+			serv := initServ(conf)
+			ts := httptest.NewServer(serv)
+			defer cleanServ(serv)
+			defer ts.Close()
+			c := ts.Client()
+
+			url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain; charset=utf-8", strings.NewReader(file)))
+			splittenURL := strings.Split(url, "/")
+			fileUUID := splittenURL[len(splittenURL)-1]
+
+			if size := storedSize(t, serv, fileUUID); size >= int64(len(file)) {
+				t.Error("File is not compressed, stored size:", size)
+			}
+
+			t.Run("encoded", func(t *testing.T) {
+				resp, body := getWithHeader(t, c, url, "Accept-Encoding", algorithm)
+				if resp.Header.Get("Content-Encoding") != algorithm {
+					t.Fatal("Wrong Content-Encoding:", resp.Header.Get("Content-Encoding"))
+				}
+				if resp.Header.Get("Vary") != "Accept-Encoding" {
+					t.Error("Missing Vary header")
+				}
+				if resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+					t.Error("Wrong Content-Type:", resp.Header.Get("Content-Type"))
+				}
+
+				var decoded []byte
+				var err error
+				if algorithm == filedrop.CompressionGzip {
+					var r *gzip.Reader
+					r, err = gzip.NewReader(strings.NewReader(string(body)))
+					if err == nil {
+						decoded, err = ioutil.ReadAll(r)
+					}
+				} else {
+					var r *zstd.Decoder
+					r, err = zstd.NewReader(strings.NewReader(string(body)))
+					if err == nil {
+						decoded, err = ioutil.ReadAll(r)
+						r.Close()
+					}
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(decoded) != file {
+					t.Error("Got different file!")
+				}
+			})
+			t.Run("identity", func(t *testing.T) {
+				resp, body := getWithHeader(t, c, url, "Accept-Encoding", "identity")
+				if resp.Header.Get("Content-Encoding") != "" {
+					t.Error("Unexpected Content-Encoding:", resp.Header.Get("Content-Encoding"))
+				}
+				if string(body) != file {
+					t.Error("Got different file!")
+				}
+			})
+			t.Run("range", func(t *testing.T) {
+				resp, body := getWithHeader(t, c, url, "Range", "bytes=100-199")
+				if resp.StatusCode != http.StatusPartialContent {
+					t.Fatal("GET: HTTP", resp.StatusCode)
+				}
+				if string(body) != file[100:200] {
+					t.Error("Got different range:", string(body))
+				}
+			})
+			t.Run("OpenFile", func(t *testing.T) {
+				r, err := serv.OpenFile(fileUUID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err := ioutil.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(body) != file {
+					t.Error("Got different file!")
+				}
+			})
+		})
+	}
+}
+
+func TestCompressionSkipped(t *testing.T) {
+	conf := filedrop.Default
+	conf.Compression.Algorithm = filedrop.CompressionGzip
+	conf.Compression.MinSize = 1024
+	serv := initServ(conf)
+	defer cleanServ(serv)
+
+	big := strings.Repeat(file, 10)
+	cases := []struct {
+		name        string
+		contentType string
+		contents    string
+		compressed  bool
+	}{
+		{"big text", "text/plain", big, true},
+		{"small text", "text/plain", file, false},
+		{"not compressible type", "image/png", big, false},
+		{"no type", "", big, false},
+	}
+	for _, c := range cases {
+		fileUUID, err := serv.AddFile(strings.NewReader(c.contents), c.contentType, 0, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := storedSize(t, serv, fileUUID)
+		if compressed := size < int64(len(c.contents)); compressed != c.compressed {
+			t.Errorf("%s: compressed = %v, want %v", c.name, compressed, c.compressed)
+		}
+
+		r, _, err := serv.GetFile(fileUUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != c.contents {
+			t.Errorf("%s: got different file", c.name)
+		}
+	}
+}
+
+func TestCompressionWithEncryption(t *testing.T) {
+	conf := filedrop.Default
+	conf.Compression.Algorithm = filedrop.CompressionZstd
+	conf.Encryption.MasterKey = genKey(t)
+	serv := initServ(conf)
+	defer cleanServ(serv)
+
+	big := strings.Repeat(file, 10)
+	fileUUID, err := serv.AddFile(strings.NewReader(big), "text/plain", 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := storedSize(t, serv, fileUUID); size >= int64(len(big)) {
+		t.Error("File is not compressed, stored size:", size)
+	}
+
+	r, err := serv.OpenFile(fileUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != big {
+		t.Error("Got different file!")
+	}
+}
+
+func TestCompressionConfigInvalid(t *testing.T) {
+	cases := []filedrop.CompressionConfig{
+		{Algorithm: "meow"},
+		{Algorithm: filedrop.CompressionGzip, MinSize: -1},
+		{Algorithm: filedrop.CompressionZstd, MinSize: -1},
+		{Algorithm: filedrop.CompressionZstd, MinSize: 1<<20 + 1},
+		{Algorithm: filedrop.CompressionGzip, Level: 10},
+	}
+	for _, compression := range cases {
+		conf := filedrop.Default
+		conf.Compression = compression
+		if _, err := filedrop.New(conf); err == nil {
+			t.Error("No error for", compression)
+		}
+	}
+}
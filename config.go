@@ -3,11 +3,19 @@ package filedrop
 import "net/http"
 
 type LimitsConfig struct {
-	// MaxUses is how much much times file can be accessed. Note that it also counts HEAD requests
-	// and incomplete downloads (byte-range requests).
+	// MaxUses is how much much times file can be downloaded. What is counted as
+	// a download is specified by UsePolicy.
 	// Per-file max-uses parameter can't exceed this value but can be smaller.
 	MaxUses  uint `yaml:"max_uses"`
 
+	// UsePolicy specifies when download is counted as a use, see UsePolicy*
+	// constants. UsePolicyRequest is used by default.
+	UsePolicy string `yaml:"use_policy"`
+
+	// UseSessionSecs is a duration of download session used to group
+	// requests of the same client. 3600 is used by default.
+	UseSessionSecs uint `yaml:"use_session_secs"`
+
 	// MaxStoreSecs specifies max time for which files will be stored on
 	// filedrop server. Per-file store-secs parameter can't exceed this value but
 	// can be smaller.
@@ -29,11 +37,257 @@ type AuthConfig struct {
 	// Callback is called to check access before processing any request.
 	// If Callback is null, no check will be performed.
 	Callback func(*http.Request) bool `yaml:"omitempty"`
+
+	// ClientCert requires request to be made over TLS connection with
+	// client certificate signed by one of CAs from TLSConfig.ClientCA.
+	// Checked before Callback.
+	ClientCert bool `yaml:"client_cert"`
+
+	// ClientNames restricts accepted client certificates to ones with
+	// matching subject CN, DNS name or e-mail address. Empty list
+	// means that any verified certificate is accepted.
+	ClientNames []string `yaml:"client_names"`
+}
+
+// Allowed checks whether request passes all configured access checks.
+func (c AuthConfig) Allowed(r *http.Request) bool {
+	if c.ClientCert && !clientCertAllowed(r, c.ClientNames) {
+		return false
+	}
+	if c.Callback != nil && !c.Callback(r) {
+		return false
+	}
+	return true
+}
+
+type TLSConfig struct {
+	// CertFile and KeyFile are paths to PEM-encoded certificate (with chain)
+	// and private key. TLS is enabled only if both are set. Files are reloaded
+	// automatically when changed on disk.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// MinVersion is a minimal accepted TLS version, one of "1.0", "1.1",
+	// "1.2" or "1.3". "1.2" is used by default.
+	MinVersion string `yaml:"min_version"`
+
+	// ClientCA is a path to PEM bundle with CAs used to verify client
+	// certificates. See AuthConfig.ClientCert.
+	ClientCA string `yaml:"client_ca"`
+
+	// DisableHTTP2 turns off HTTP/2 support, which is enabled by default for TLS.
+	DisableHTTP2 bool `yaml:"disable_http2"`
+}
+
+// Endpoints is a list of listener addresses which can be specified in YAML
+// either as a list or as a single string.
+type Endpoints []string
+
+func (e *Endpoints) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*e = Endpoints{single}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*e = list
+	return nil
+}
+
+type HealthConfig struct {
+	// LivenessPath is a URL path for liveness probe endpoint, like "/healthz".
+	// Endpoint is disabled if path is empty.
+	LivenessPath string `yaml:"liveness_path"`
+
+	// ReadinessPath is a URL path for readiness probe endpoint, like "/readyz".
+	// Endpoint is disabled if path is empty.
+	ReadinessPath string `yaml:"readiness_path"`
+
+	// MinFreeBytes is a minimal amount of free space in StorageDir required
+	// for server to be considered ready.
+	MinFreeBytes uint64 `yaml:"min_free_bytes"`
+}
+
+type WebhookConfig struct {
+	// URL to POST JSON event payloads to. URLs of webhooks must be
+	// unique, events of several types are selected using Events.
+	URL string `yaml:"url"`
+
+	// Secret is used to sign payloads using HMAC-SHA256. Signature is sent
+	// in X-Filedrop-Signature header in format "sha256=HEX".
+	Secret string `yaml:"secret"`
+
+	// Events is a list of event types to deliver. All events are delivered
+	// if list is empty.
+	Events []EventType `yaml:"events"`
+
+	// MaxAttempts is how much times delivery is attempted before event is
+	// dropped. 10 is used by default.
+	MaxAttempts int `yaml:"max_attempts"`
+
+	// TimeoutSecs is a timeout for each delivery attempt. 10 is used by default.
+	TimeoutSecs int `yaml:"timeout_secs"`
+}
+
+type EncryptionConfig struct {
+	// MasterKey is a 256-bit key (hex or base64 encoded) used to encrypt
+	// per-file data keys.
+	MasterKey string `yaml:"master_key"`
+
+	// MasterKeyFile is a path to file containing master key, used
+	// instead of MasterKey if set.
+	MasterKeyFile string `yaml:"master_key_file"`
+}
+
+type CompressionConfig struct {
+	// Algorithm is "gzip" or "zstd". Compression is disabled if empty.
+	Algorithm string `yaml:"algorithm"`
+
+	// Level is algorithm-specific compression level, default is used if 0.
+	Level int `yaml:"level"`
+
+	// MinSize is a minimal file size in bytes for it to be compressed,
+	// at most 1 MiB.
+	MinSize int `yaml:"min_size"`
+
+	// ContentTypes lists types of files that should be compressed. Entries
+	// ending with "/" match all subtypes (like "text/"). Text, JSON, XML,
+	// JavaScript and SVG are compressed by default.
+	ContentTypes []string `yaml:"content_types"`
+}
+
+type PasswordConfig struct {
+	// MaxAttempts is how much wrong passwords in a row are allowed before
+	// file is locked. 5 is used by default.
+	MaxAttempts int `yaml:"max_attempts"`
+
+	// LockoutSecs is for how long file is locked after MaxAttempts wrong
+	// passwords. 900 is used by default.
+	LockoutSecs int `yaml:"lockout_secs"`
+}
+
+type OffloadConfig struct {
+	// Mode is "x-accel-redirect" (nginx) or "x-sendfile" (Apache,
+	// lighttpd). Offload is disabled if empty.
+	Mode string `yaml:"mode"`
+
+	// Location is a prefix for header value. For X-Accel-Redirect it is a
+	// URI of internal location serving StorageDir, like "/filedrop-files/",
+	// and it is required. For X-Sendfile it is a path to StorageDir as seen
+	// by the proxy, absolute path to StorageDir is used if empty.
+	Location string `yaml:"location"`
+}
+
+type PreviewBotsConfig struct {
+	// Enabled turns on detection of link preview crawlers. Detected
+	// crawlers get page with OpenGraph metadata instead of file contents,
+	// range requests probing beginning of the file are served without
+	// counting a use.
+	Enabled bool `yaml:"enabled"`
+
+	// UserAgents lists regular expressions (case-insensitive) matching
+	// User-Agent of crawlers. Crawlers of popular chat apps are matched
+	// by default.
+	UserAgents []string `yaml:"user_agents"`
+
+	// ProbeBytes is a maximum size of range probe. 65536 is used by
+	// default.
+	ProbeBytes int `yaml:"probe_bytes"`
+}
+
+type PasteConfig struct {
+	// Enabled turns on paste mode: browsers opening text file get page
+	// with highlighted contents, text can be uploaded using HTML form
+	// ("paste" field).
+	Enabled bool `yaml:"enabled"`
+
+	// Style is a name of highlighting style, see
+	// https://xyproto.github.io/splash/docs/. "github" is used by default.
+	Style string `yaml:"style"`
+
+	// MaxViewSize is a maximum size of file in bytes shown as paste,
+	// larger files are served as is. 1 MiB is used by default.
+	MaxViewSize int `yaml:"max_view_size"`
+}
+
+type ThumbnailsConfig struct {
+	// Enabled turns on thumbnails of PNG, JPEG and GIF images, requested
+	// using "w" query parameter (width in pixels). Thumbnails are cached
+	// in "thumbnails" subdirectory of StorageDir and are not counted as
+	// uses of file, so files with max uses set don't get them.
+	Enabled bool `yaml:"enabled"`
+
+	// Widths lists allowed thumbnail widths. 160, 320, 640 and 1280 are
+	// allowed by default.
+	Widths []int `yaml:"widths"`
+
+	// MaxPixels is a maximum size of source image (width * height),
+	// larger images don't get thumbnails. 50 megapixels are allowed by
+	// default.
+	MaxPixels int `yaml:"max_pixels"`
+}
+
+type IDsConfig struct {
+	// Generator is how IDs of uploaded files are generated: "uuid"
+	// (default), "base62" (random letters and digits) or "words"
+	// (random words separated by "-"). Links to existing files remain
+	// valid after change.
+	Generator string `yaml:"generator"`
+
+	// Length is a number of characters for "base62" generator (8 by
+	// default) or number of words for "words" generator (4 by default).
+	Length int `yaml:"length"`
+
+	// Slugs allows uploader to choose file ID using "slug" query
+	// parameter. Slug should be 3 to 36 characters long and consist of
+	// ASCII letters, digits, "-" and "_". Taken slugs, UUIDs and
+	// components of paths served by Server are rejected.
+	//
+	// If enabled, links don't include upload URL path: they are
+	// DownloadURL/ID or BaseURL/ID (or just /ID), so ID is at fixed
+	// position and slugs can't take over links of other files.
+	Slugs bool `yaml:"slugs"`
+}
+
+type ContentTypesConfig struct {
+	// Sniff makes filedrop detect content type of uploads sent without
+	// one (or with application/octet-stream). Uploads that look like HTML
+	// or XML are always stored with detected type.
+	Sniff bool `yaml:"sniff"`
+
+	// Allowed lists content types accepted on upload, all types are
+	// accepted if empty. Entries ending with "/" match all subtypes (like
+	// "image/").
+	Allowed []string `yaml:"allowed"`
+
+	// Denied lists content types rejected on upload.
+	Denied []string `yaml:"denied"`
+
+	// Dangerous lists content types that can run scripts in browser
+	// (HTML, SVG, XML, JavaScript by default).
+	Dangerous []string `yaml:"dangerous"`
+
+	// DangerousAction is how files of dangerous types are served:
+	// "attachment" (default) makes browsers download them, "text" serves
+	// them as text/plain.
+	DangerousAction string `yaml:"dangerous_action"`
 }
 
 type Config struct {
-	// ListenOn specifies endpoint to listen on in format ADDR:PORT. Used only by filedropd.
-	ListenOn string `yaml:"listen_on"`
+	// ListenOn specifies endpoints to listen on. Used only by filedropd.
+	// Each endpoint is either ADDR:PORT for TCP or unix:/path for Unix socket.
+	// Ignored if sockets are passed by systemd (socket activation).
+	ListenOn Endpoints `yaml:"listen_on"`
+
+	// SocketPerms specifies permissions (octal, like "0660") for created
+	// Unix sockets. Used only by filedropd.
+	SocketPerms string `yaml:"socket_perms"`
+
+	// TLS configures TLS termination. Used only by filedropd.
+	TLS TLSConfig `yaml:"tls"`
 
 	Limits          LimitsConfig `yaml:"limits"`
 	DB              DBConfig     `yaml:"db"`
@@ -43,10 +297,109 @@ type Config struct {
 	// StorageDir is where files will be saved on disk.
 	StorageDir  string  `yaml:"storage_dir"`
 
+	// Dedup enables content-addressed storage: files with the same contents
+	// are stored once in "blobs" subdirectory of StorageDir. Files uploaded
+	// before it was enabled are not affected. StorageDir should not be
+	// shared by several instances if it is enabled.
+	Dedup bool `yaml:"dedup"`
+
+	// Encryption enables encryption of stored files if master key is set.
+	// Files uploaded before it was enabled are not affected. Can't be used
+	// together with Dedup.
+	Encryption EncryptionConfig `yaml:"encryption"`
+
+	// Compression enables compression of stored files. Files are served
+	// compressed if client accepts it and decompressed otherwise. Can't be
+	// used together with Dedup.
+	Compression CompressionConfig `yaml:"compression"`
+
+	// ContentTypes configures detection and restrictions of content
+	// types.
+	ContentTypes ContentTypesConfig `yaml:"content_types"`
+
+	// StripMetadata enables removal of EXIF (including GPS location), XMP
+	// and other metadata from uploaded JPEG and PNG images. It can be
+	// changed per upload using "strip-metadata" query parameter. Note that
+	// image orientation stored in EXIF is removed too.
+	StripMetadata bool `yaml:"strip_metadata"`
+
+	// Passwords configures brute-force protection for password-protected
+	// files.
+	Passwords PasswordConfig `yaml:"passwords"`
+
+	// E2EPagePath is a URL path for built-in page that encrypts files in
+	// browser before upload, like "/send". Page is disabled if path is
+	// empty. Encrypted uploads are accepted on any endpoint regardless of
+	// this option.
+	E2EPagePath string `yaml:"e2e_page_path"`
+
+	// UploadPage makes filedrop serve upload page to browsers requesting
+	// upload endpoint (any URL without file ID).
+	UploadPage bool `yaml:"upload_page"`
+
+	// LandingPage makes filedrop serve page with file information and
+	// download button to browsers instead of file contents, so opening
+	// link doesn't count as a use. Contents is served if "raw" query
+	// parameter is set.
+	LandingPage bool `yaml:"landing_page"`
+
+	// PreviewBots configures handling of link preview crawlers, so
+	// posting link to chat doesn't count as a use.
+	PreviewBots PreviewBotsConfig `yaml:"preview_bots"`
+
+	// Paste configures paste mode.
+	Paste PasteConfig `yaml:"paste"`
+
+	// Thumbnails configures scaled down copies of images.
+	Thumbnails ThumbnailsConfig `yaml:"thumbnails"`
+
+	// IDs configures generation of file IDs used in links.
+	IDs IDsConfig `yaml:"ids"`
+
+	// WebDir is a directory with files overriding built-in page templates
+	// (upload.html, download.html, preview.html, paste.html) and static
+	// assets. Assets are served under "/.assets/" path and referenced from
+	// pages as "{{.AssetsPath}}NAME".
+	WebDir string `yaml:"web_dir"`
+
+	// Offload makes reverse proxy send file contents instead of filedrop.
+	// Encrypted and compressed files are always served by filedrop.
+	Offload OffloadConfig `yaml:"offload"`
+
+	// DownloadURL is a public base URL of files, like
+	// "https://files.example.org/d", used in links returned on upload. If
+	// set, files are served only for requests with its host (in Host
+	// header) and uploads there are rejected, so user content is isolated
+	// on separate origin. Requests for other hosts are handled as uploads.
+	DownloadURL string `yaml:"download_url"`
+
+	// BaseURL is a public URL filedrop is available at, like
+	// "https://example.org/files", request path is appended to it to
+	// build links returned on upload. If not set, request URL is used
+	// (adjusted by headers of trusted proxies). DownloadURL takes
+	// precedence if set.
+	BaseURL string `yaml:"base_url"`
+
+	// TrustedProxies lists CIDRs and IP addresses of reverse proxies
+	// whose Forwarded, X-Forwarded-Proto, X-Forwarded-Host and
+	// X-Forwarded-Prefix headers are used to build links and Forwarded or
+	// X-Forwarded-For headers to identify clients in download sessions.
+	// "unix" matches connections over Unix sockets. Headers are ignored
+	// for other clients.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
 	// HTTPSDownstream specifies whether filedrop should return links with https scheme or not.
-	// Overridden by X-HTTPS-Downstream header.
+	// Overridden by X-HTTPS-Downstream header. Implied for requests received
+	// over TLS.
 	HTTPSDownstream bool `yaml:"https_downstream"`
 
+	// Health configures liveness and readiness probe endpoints. Probes
+	// are not subject to DownloadAuth checks.
+	Health HealthConfig `yaml:"health"`
+
+	// Webhooks specifies URLs to notify about file lifecycle events.
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+
 	// AllowedOrigins specifies Access-Control-Allow-Origin header.
 	AllowedOrigins string `yaml:"allowed_origins"`
 
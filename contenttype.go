@@ -0,0 +1,136 @@
+package filedrop
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DangerousAttachment makes browsers download files of dangerous
+	// types instead of opening them.
+	DangerousAttachment = "attachment"
+
+	// DangerousText makes filedrop serve files of dangerous types as
+	// plain text.
+	DangerousText = "text"
+)
+
+// defaultDangerousTypes lists types that can run scripts when opened in
+// browser.
+var defaultDangerousTypes = []string{
+	"text/html",
+	"application/xhtml+xml",
+	"image/svg+xml",
+	"text/xml",
+	"application/xml",
+	"text/xsl",
+	"application/xslt+xml",
+	"text/javascript",
+	"application/javascript",
+	"application/x-javascript",
+	"application/ecmascript",
+	"multipart/x-mixed-replace",
+}
+
+// fileCSP is a Content-Security-Policy for all responses except pages
+// which set their own one. It makes documents opened from filedrop origin
+// unable to run scripts or load anything.
+const fileCSP = "default-src 'none'; style-src 'unsafe-inline'; img-src 'self' data:; media-src 'self'; sandbox"
+
+// sniffLen is how much bytes are used by http.DetectContentType.
+const sniffLen = 512
+
+func (c ContentTypesConfig) validate() error {
+	switch c.DangerousAction {
+	case "", DangerousAttachment, DangerousText:
+		return nil
+	default:
+		return errors.New("unknown dangerous_action: " + c.DangerousAction)
+	}
+}
+
+// matchContentType checks whether content type is in the list. Entries
+// ending with "/" match all subtypes, parameters are ignored.
+func matchContentType(types []string, contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	for _, t := range types {
+		if strings.HasSuffix(t, "/") && strings.HasPrefix(contentType, t) {
+			return true
+		}
+		if contentType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed checks whether files with specified content type can be
+// uploaded.
+func (c ContentTypesConfig) allowed(contentType string) bool {
+	if matchContentType(c.Denied, contentType) {
+		return false
+	}
+	return len(c.Allowed) == 0 || matchContentType(c.Allowed, contentType)
+}
+
+func (c ContentTypesConfig) dangerous(contentType string) bool {
+	types := c.Dangerous
+	if len(types) == 0 {
+		types = defaultDangerousTypes
+	}
+	return matchContentType(types, contentType)
+}
+
+// sniffContentType returns content type stored for upload with declared
+// type and contents beginning with head.
+//
+// Detected type is used if contents looks like active content (HTML,
+// XML) disguised as something harmless. If sniff is true, it is also used
+// when declared type is missing or generic.
+func (c ContentTypesConfig) sniffContentType(declared string, head []byte) string {
+	detected := http.DetectContentType(head)
+	if c.dangerous(detected) && !c.dangerous(declared) {
+		return detected
+	}
+	if !c.Sniff {
+		return declared
+	}
+	mediaType, _, err := mime.ParseMediaType(declared)
+	if err != nil || mediaType == "application/octet-stream" {
+		return detected
+	}
+	return declared
+}
+
+// servedContentType returns Content-Type header value used for file with
+// specified stored type.
+func (c ContentTypesConfig) servedContentType(contentType string) string {
+	if contentType == "" {
+		// Prevent browser and http.ServeContent from guessing it.
+		return "application/octet-stream"
+	}
+	if c.DangerousAction == DangerousText && c.dangerous(contentType) {
+		return "text/plain"
+	}
+	return contentType
+}
+
+// contentDisposition returns Content-Disposition header value used for
+// file. fileName is a name from URL, it may be empty.
+func (c ContentTypesConfig) contentDisposition(contentType, fileName string) string {
+	disposition := "inline"
+	if c.DangerousAction != DangerousText && c.dangerous(contentType) {
+		disposition = "attachment"
+	}
+	params := map[string]string{}
+	if fileName != "" {
+		params["filename"] = fileName
+	}
+	return mime.FormatMediaType(disposition, params)
+}
@@ -0,0 +1,138 @@
+package filedrop_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/filedrop"
+)
+
+const htmlFile = "<!DOCTYPE html><html><script>alert(document.cookie)</script></html>"
+
+func checkFileHeaders(t *testing.T, resp *http.Response, contentType, disposition string) {
+	t.Helper()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("GET: HTTP", resp.StatusCode, resp.Status)
+	}
+	if resp.Header.Get("Content-Type") != contentType {
+		t.Error("Wrong Content-Type:", resp.Header.Get("Content-Type"))
+	}
+	if resp.Header.Get("Content-Disposition") != disposition {
+		t.Error("Wrong Content-Disposition:", resp.Header.Get("Content-Disposition"))
+	}
+	if resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("X-Content-Type-Options is not set")
+	}
+	if !strings.Contains(resp.Header.Get("Content-Security-Policy"), "sandbox") {
+		t.Error("CSP sandbox is not set:", resp.Header.Get("Content-Security-Policy"))
+	}
+}
+
+func TestDangerousTypes(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	cases := []struct {
+		name        string
+		fileName    string
+		contentType string
+		contents    string
+
+		servedType  string
+		disposition string
+	}{
+		{"html", "", "text/html", htmlFile, "text/html", "attachment"},
+		{"svg", "/cat.svg", "image/svg+xml", `<svg xmlns="http://www.w3.org/2000/svg"></svg>`, "image/svg+xml", "attachment; filename=cat.svg"},
+		{"disguised html", "/cat.png", "image/png", htmlFile, "text/html; charset=utf-8", "attachment; filename=cat.png"},
+		{"text", "/cat.txt", "text/plain", file, "text/plain", "inline; filename=cat.txt"},
+		{"unknown type", "", "", file, "application/octet-stream", "inline"},
+	}
+	for _, case_ := range cases {
+		t.Run(case_.name, func(t *testing.T) {
+			url := string(doPOST(t, c, ts.URL+"/filedrop", case_.contentType, strings.NewReader(case_.contents)))
+			resp, _ := getWithHeader(t, c, url+case_.fileName, "Accept", "*/*")
+			checkFileHeaders(t, resp, case_.servedType, case_.disposition)
+		})
+	}
+}
+
+func TestDangerousAsText(t *testing.T) {
+	conf := filedrop.Default
+	conf.ContentTypes.DangerousAction = filedrop.DangerousText
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/html", strings.NewReader(htmlFile)))
+	resp, body := getWithHeader(t, c, url, "Accept", "*/*")
+	checkFileHeaders(t, resp, "text/plain", "inline")
+	if string(body) != htmlFile {
+		t.Error("Got different file!")
+	}
+}
+
+func TestContentTypeSniff(t *testing.T) {
+	conf := filedrop.Default
+	conf.ContentTypes.Sniff = true
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	cases := []struct {
+		declared string
+		detected string
+	}{
+		{"", "image/png"},
+		{"application/octet-stream", "image/png"},
+		// Declared type is kept if it is not generic.
+		{"image/x-custom", "image/x-custom"},
+	}
+	for _, case_ := range cases {
+		url := string(doPOST(t, c, ts.URL+"/filedrop", case_.declared, bytes.NewReader(testImage(t, "png"))))
+		resp, _ := getWithHeader(t, c, url, "Accept", "*/*")
+		if resp.Header.Get("Content-Type") != case_.detected {
+			t.Error("Wrong Content-Type for", case_.declared+":", resp.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestContentTypeRestrictions(t *testing.T) {
+	conf := filedrop.Default
+	conf.ContentTypes.Allowed = []string{"image/", "text/plain"}
+	conf.ContentTypes.Denied = []string{"image/svg+xml"}
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	doPOST(t, c, ts.URL+"/filedrop", "image/png", bytes.NewReader(testImage(t, "png")))
+	doPOST(t, c, ts.URL+"/filedrop", "text/plain; charset=utf-8", strings.NewReader(file))
+
+	cases := []struct {
+		contentType string
+		contents    string
+	}{
+		{"application/zip", file},
+		{"image/svg+xml", `<svg xmlns="http://www.w3.org/2000/svg"></svg>`},
+		// Detected type is checked.
+		{"image/png", htmlFile},
+	}
+	for _, case_ := range cases {
+		code := doPOSTFail(t, c, ts.URL+"/filedrop", case_.contentType, strings.NewReader(case_.contents))
+		if code != http.StatusUnsupportedMediaType {
+			t.Error("POST", case_.contentType+": HTTP", code)
+		}
+	}
+}
@@ -15,14 +15,49 @@ type db struct {
 	addFile     *sql.Stmt
 	remFile     *sql.Stmt
 	contentType *sql.Stmt
+	fileInfo    *sql.Stmt
 
 	addUse           *sql.Stmt
 	shouldDelete     *sql.Stmt
 	removeStaleFiles *sql.Stmt
 	staleFiles       *sql.Stmt
+
+	addBlob     *sql.Stmt
+	incBlobRefs *sql.Stmt
+	decBlobRefs *sql.Stmt
+	blobRefs    *sql.Stmt
+	remBlob     *sql.Stmt
+
+	dataKeys   *sql.Stmt
+	setDataKey *sql.Stmt
+
+	addFailedAttempt    *sql.Stmt
+	failedAttempts      *sql.Stmt
+	lockFile            *sql.Stmt
+	resetFailedAttempts *sql.Stmt
+
+	addOutbox     *sql.Stmt
+	pendingOutbox *sql.Stmt
+	remOutbox     *sql.Stmt
+	retryOutbox   *sql.Stmt
 }
 
 func openDB(driver, dsn string) (*db, error) {
+	db, err := connectDB(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Migrate(false); err != nil {
+		db.Close()
+		return nil, err
+	}
+	db.initStmts()
+	return db, nil
+}
+
+// connectDB opens database without any schema initialization.
+func connectDB(driver, dsn string) (*db, error) {
 	if driver == "sqlite3" {
 		// We apply some tricks for SQLite to avoid "database is locked" errors.
 
@@ -56,24 +91,9 @@ func openDB(driver, dsn string) (*db, error) {
 		db.Exec(`PRAGMA cache_size = 5000`)
 	}
 
-	db.initSchema()
-	db.initStmts()
 	return db, nil
 }
 
-func (db *db) initSchema() {
-	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS filedrop (
-		uuid CHAR(36) PRIMARY KEY NOT NULL,
-		contentType VARCHAR(255) DEFAULT NULL,
-		uses INTEGER NOT NULL DEFAULT 0,
-		maxUses INTEGER DEFAULT NULL,
-		storeUntil BIGINT DEFAULT NULL
-	)`)
-	if err != nil {
-		panic(err)
-	}
-}
-
 func (db *db) reformatBindvars(raw string) (res string) {
 	// THIS IS VERY LIMITED IMPLEMENTATION.
 	// If someday this will become not enough - just switch to https://github.com/jmoiron/sqlx.
@@ -98,7 +118,7 @@ func (db *db) Prepare(query string) (*sql.Stmt, error) {
 
 func (db *db) initStmts() {
 	var err error
-	db.addFile, err = db.Prepare(`INSERT INTO filedrop(uuid, contentType, maxUses, storeUntil) VALUES (?, ?, ?, ?)`)
+	db.addFile, err = db.Prepare(`INSERT INTO filedrop(uuid, contentType, maxUses, storeUntil, size, sha256, createdAt, blobHash, dataKey, encryption, compression, passwordHash, sanitized) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		panic(err)
 	}
@@ -110,11 +130,15 @@ func (db *db) initStmts() {
 	if err != nil {
 		panic(err)
 	}
+	db.fileInfo, err = db.Prepare(`SELECT contentType, uses, maxUses, storeUntil, size, sha256, createdAt, blobHash, dataKey, encryption, compression, passwordHash, failedAttempts, lockedUntil, sanitized FROM filedrop WHERE uuid = ?`)
+	if err != nil {
+		panic(err)
+	}
 	db.shouldDelete, err = db.Prepare(`SELECT EXISTS(SELECT uuid FROM filedrop WHERE uuid = ? AND (storeUntil < ? OR maxUses = uses))`)
 	if err != nil {
 		panic(err)
 	}
-	db.addUse, err = db.Prepare(`UPDATE filedrop SET uses = uses + 1 WHERE uuid = ?`)
+	db.addUse, err = db.Prepare(`UPDATE filedrop SET uses = uses + 1 WHERE uuid = ? AND (maxUses IS NULL OR uses < maxUses)`)
 	if err != nil {
 		panic(err)
 	}
@@ -126,18 +150,90 @@ func (db *db) initStmts() {
 	if err != nil {
 		panic(err)
 	}
+	db.addBlob, err = db.Prepare(`INSERT INTO filedrop_blobs(sha256, refs) VALUES (?, 1)`)
+	if err != nil {
+		panic(err)
+	}
+	db.incBlobRefs, err = db.Prepare(`UPDATE filedrop_blobs SET refs = refs + 1 WHERE sha256 = ?`)
+	if err != nil {
+		panic(err)
+	}
+	db.decBlobRefs, err = db.Prepare(`UPDATE filedrop_blobs SET refs = refs - 1 WHERE sha256 = ?`)
+	if err != nil {
+		panic(err)
+	}
+	db.blobRefs, err = db.Prepare(`SELECT refs FROM filedrop_blobs WHERE sha256 = ?`)
+	if err != nil {
+		panic(err)
+	}
+	db.remBlob, err = db.Prepare(`DELETE FROM filedrop_blobs WHERE sha256 = ?`)
+	if err != nil {
+		panic(err)
+	}
+	db.dataKeys, err = db.Prepare(`SELECT uuid, dataKey FROM filedrop WHERE dataKey IS NOT NULL`)
+	if err != nil {
+		panic(err)
+	}
+	db.setDataKey, err = db.Prepare(`UPDATE filedrop SET dataKey = ? WHERE uuid = ?`)
+	if err != nil {
+		panic(err)
+	}
+	db.addFailedAttempt, err = db.Prepare(`UPDATE filedrop SET failedAttempts = failedAttempts + 1 WHERE uuid = ?`)
+	if err != nil {
+		panic(err)
+	}
+	db.failedAttempts, err = db.Prepare(`SELECT failedAttempts FROM filedrop WHERE uuid = ?`)
+	if err != nil {
+		panic(err)
+	}
+	db.lockFile, err = db.Prepare(`UPDATE filedrop SET failedAttempts = 0, lockedUntil = ? WHERE uuid = ?`)
+	if err != nil {
+		panic(err)
+	}
+	db.resetFailedAttempts, err = db.Prepare(`UPDATE filedrop SET failedAttempts = 0 WHERE uuid = ?`)
+	if err != nil {
+		panic(err)
+	}
+	db.addOutbox, err = db.Prepare(`INSERT INTO filedrop_outbox(id, target, payload, nextAttempt) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		panic(err)
+	}
+	db.pendingOutbox, err = db.Prepare(`SELECT id, target, payload, attempts FROM filedrop_outbox WHERE nextAttempt <= ? ORDER BY nextAttempt LIMIT 100`)
+	if err != nil {
+		panic(err)
+	}
+	db.remOutbox, err = db.Prepare(`DELETE FROM filedrop_outbox WHERE id = ?`)
+	if err != nil {
+		panic(err)
+	}
+	db.retryOutbox, err = db.Prepare(`UPDATE filedrop_outbox SET attempts = ?, nextAttempt = ? WHERE id = ?`)
+	if err != nil {
+		panic(err)
+	}
 }
 
-func (db *db) AddFile(tx *sql.Tx, uuid string, contentType string, maxUses uint, storeUntil time.Time) error {
-	maxUsesN := sql.NullInt64{Int64: int64(maxUses), Valid: maxUses != 0}
-	storeUntilN := sql.NullInt64{Int64: storeUntil.Unix(), Valid: !storeUntil.IsZero()}
-	contentTypeN := sql.NullString{String: contentType, Valid: contentType != ""}
+func (db *db) AddFile(tx *sql.Tx, info FileInfo) error {
+	maxUsesN := sql.NullInt64{Int64: int64(info.MaxUses), Valid: info.MaxUses != 0}
+	storeUntilN := sql.NullInt64{Int64: info.StoreUntil.Unix(), Valid: !info.StoreUntil.IsZero()}
+	contentTypeN := sql.NullString{String: info.ContentType, Valid: info.ContentType != ""}
+	sizeN := sql.NullInt64{Int64: info.Size, Valid: info.Size >= 0}
+	sha256N := sql.NullString{String: info.SHA256, Valid: info.SHA256 != ""}
+	createdAtN := sql.NullInt64{Int64: info.CreatedAt.Unix(), Valid: !info.CreatedAt.IsZero()}
+	blobN := sql.NullString{String: info.blob, Valid: info.blob != ""}
+	dataKeyN := sql.NullString{String: info.dataKey, Valid: info.dataKey != ""}
+	encryptionN := sql.NullString{String: info.Encryption, Valid: info.Encryption != ""}
+	compressionN := sql.NullString{String: info.compression, Valid: info.compression != ""}
+	passwordHashN := sql.NullString{String: info.passwordHash, Valid: info.passwordHash != ""}
+	sanitized := 0
+	if info.Sanitized {
+		sanitized = 1
+	}
 
 	if tx != nil {
-		_, err := tx.Stmt(db.addFile).Exec(uuid, contentTypeN, maxUsesN, storeUntilN)
+		_, err := tx.Stmt(db.addFile).Exec(info.UUID, contentTypeN, maxUsesN, storeUntilN, sizeN, sha256N, createdAtN, blobN, dataKeyN, encryptionN, compressionN, passwordHashN, sanitized)
 		return err
 	} else {
-		_, err := db.addFile.Exec(uuid, contentTypeN, maxUsesN, storeUntilN)
+		_, err := db.addFile.Exec(info.UUID, contentTypeN, maxUsesN, storeUntilN, sizeN, sha256N, createdAtN, blobN, dataKeyN, encryptionN, compressionN, passwordHashN, sanitized)
 		return err
 	}
 }
@@ -196,6 +292,198 @@ func (db *db) ContentType(tx *sql.Tx, fileUUID string) (string, error) {
 	return res.String, row.Scan(&res)
 }
 
+func (db *db) FileInfo(tx *sql.Tx, fileUUID string) (FileInfo, error) {
+	var row *sql.Row
+	if tx != nil {
+		row = tx.Stmt(db.fileInfo).QueryRow(fileUUID)
+	} else {
+		row = db.fileInfo.QueryRow(fileUUID)
+	}
+
+	contentType := sql.NullString{}
+	maxUses := sql.NullInt64{}
+	storeUntil := sql.NullInt64{}
+	size := sql.NullInt64{}
+	sha256 := sql.NullString{}
+	createdAt := sql.NullInt64{}
+	blob := sql.NullString{}
+	dataKey := sql.NullString{}
+	encryption := sql.NullString{}
+	compression := sql.NullString{}
+	passwordHash := sql.NullString{}
+	lockedUntil := sql.NullInt64{}
+	sanitized := 0
+	info := FileInfo{UUID: fileUUID, Size: -1}
+	if err := row.Scan(&contentType, &info.Uses, &maxUses, &storeUntil, &size, &sha256, &createdAt, &blob, &dataKey, &encryption, &compression,
+		&passwordHash, &info.failedAttempts, &lockedUntil, &sanitized); err != nil {
+		return info, err
+	}
+	info.Sanitized = sanitized != 0
+	info.passwordHash = passwordHash.String
+	if lockedUntil.Valid {
+		info.lockedUntil = time.Unix(lockedUntil.Int64, 0)
+	}
+	info.compression = compression.String
+	info.Encryption = encryption.String
+	info.blob = blob.String
+	info.dataKey = dataKey.String
+	info.ContentType = contentType.String
+	info.MaxUses = uint(maxUses.Int64)
+	if storeUntil.Valid {
+		info.StoreUntil = time.Unix(storeUntil.Int64, 0)
+	}
+	if size.Valid {
+		info.Size = size.Int64
+	}
+	info.SHA256 = sha256.String
+	if createdAt.Valid {
+		info.CreatedAt = time.Unix(createdAt.Int64, 0)
+	}
+	return info, nil
+}
+
+// AcquireBlob adds reference to blob with specified hash. created is true
+// if blob didn't exist before and caller should store its contents.
+//
+// Counter row is locked until tx is finished so concurrent
+// AcquireBlob and ReleaseBlob calls for the same hash are serialized.
+func (db *db) AcquireBlob(tx *sql.Tx, sha256 string) (created bool, err error) {
+	res, err := tx.Stmt(db.incBlobRefs).Exec(sha256)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected != 0 {
+		return false, nil
+	}
+	if _, err := tx.Stmt(db.addBlob).Exec(sha256); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ReleaseBlob removes reference to blob with specified hash. removed is
+// true if it was the last reference and blob contents should be removed.
+func (db *db) ReleaseBlob(tx *sql.Tx, sha256 string) (removed bool, err error) {
+	if _, err := tx.Stmt(db.decBlobRefs).Exec(sha256); err != nil {
+		return false, err
+	}
+	refs := 0
+	if err := tx.Stmt(db.blobRefs).QueryRow(sha256).Scan(&refs); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	if refs > 0 {
+		return false, nil
+	}
+	if _, err := tx.Stmt(db.remBlob).Exec(sha256); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// queryRetries is how much times read queries made outside of
+// transaction are retried. SQLite in shared cache mode fails them
+// immediately if table is locked by concurrent transaction.
+const queryRetries = 10
+
+func retryQuery(query func() error) error {
+	var err error
+	for i := 0; i < queryRetries; i++ {
+		err = query()
+		if err == nil || err == sql.ErrNoRows {
+			return err
+		}
+		time.Sleep(time.Duration(i+1) * 10 * time.Millisecond)
+	}
+	return err
+}
+
+// BlobExists checks whether blob with specified hash is referenced.
+func (db *db) BlobExists(sha256 string) (bool, error) {
+	refs := 0
+	err := retryQuery(func() error {
+		return db.blobRefs.QueryRow(sha256).Scan(&refs)
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// DataKeys returns wrapped data keys of all encrypted files, indexed
+// by file UUID.
+func (db *db) DataKeys(tx *sql.Tx) (map[string]string, error) {
+	keys := make(map[string]string)
+	rows, err := tx.Stmt(db.dataKeys).Query()
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		uuid, key := "", ""
+		if err := rows.Scan(&uuid, &key); err != nil {
+			return keys, err
+		}
+		keys[uuid] = key
+	}
+	return keys, rows.Err()
+}
+
+func (db *db) SetDataKey(tx *sql.Tx, uuid, key string) error {
+	_, err := tx.Stmt(db.setDataKey).Exec(key, uuid)
+	return err
+}
+
+// PasswordFailed records failed password attempt and locks file until
+// lockUntil if there were maxAttempts failed attempts in a row. locked is
+// true if file was locked by this call.
+func (db *db) PasswordFailed(fileUUID string, maxAttempts int, lockUntil time.Time) (locked bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() // rollback is no-op after commit
+
+	if _, err := tx.Stmt(db.addFailedAttempt).Exec(fileUUID); err != nil {
+		return false, err
+	}
+	attempts := 0
+	if err := tx.Stmt(db.failedAttempts).QueryRow(fileUUID).Scan(&attempts); err != nil {
+		return false, err
+	}
+	if attempts >= maxAttempts {
+		if _, err := tx.Stmt(db.lockFile).Exec(lockUntil.Unix(), fileUUID); err != nil {
+			return false, err
+		}
+		locked = true
+	}
+	return locked, tx.Commit()
+}
+
+func (db *db) ResetFailedAttempts(fileUUID string) error {
+	_, err := db.resetFailedAttempts.Exec(fileUUID)
+	return err
+}
+
+// Probe executes trivial query on filedrop table to make sure it is usable.
+func (db *db) Probe() error {
+	var uuid string
+	err := db.QueryRow(`SELECT uuid FROM filedrop LIMIT 1`).Scan(&uuid)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
 func (db *db) StaleFiles(tx *sql.Tx, now time.Time) ([]string, error) {
 	uuids := []string{}
 	var rows *sql.Rows
@@ -227,3 +515,44 @@ func (db *db) RemoveStaleFiles(tx *sql.Tx, now time.Time) error {
 		return err
 	}
 }
+
+type outboxEntry struct {
+	ID       string
+	Target   string
+	Payload  []byte
+	Attempts int
+}
+
+func (db *db) AddOutbox(id, target string, payload []byte) error {
+	_, err := db.addOutbox.Exec(id, target, string(payload), time.Now().Unix())
+	return err
+}
+
+func (db *db) PendingOutbox(now time.Time) ([]outboxEntry, error) {
+	entries := []outboxEntry{}
+	rows, err := db.pendingOutbox.Query(now.Unix())
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry := outboxEntry{}
+		payload := ""
+		if err := rows.Scan(&entry.ID, &entry.Target, &payload, &entry.Attempts); err != nil {
+			return entries, err
+		}
+		entry.Payload = []byte(payload)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (db *db) RemoveOutbox(id string) error {
+	_, err := db.remOutbox.Exec(id)
+	return err
+}
+
+func (db *db) RetryOutbox(id string, attempts int, nextAttempt time.Time) error {
+	_, err := db.retryOutbox.Exec(attempts, nextAttempt.Unix(), id)
+	return err
+}
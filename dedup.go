@@ -0,0 +1,146 @@
+package filedrop
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// How much times upload transaction is retried if it conflicts with
+// concurrent upload of the same blob.
+const blobTxRetries = 10
+
+func (s *Server) blobsDir() string {
+	return filepath.Join(s.Conf.StorageDir, "blobs")
+}
+
+// storagePath returns location of file contents on disk.
+func (s *Server) storagePath(info FileInfo) string {
+	if info.blob != "" {
+		return filepath.Join(s.blobsDir(), info.blob)
+	}
+	return filepath.Join(s.Conf.StorageDir, info.UUID)
+}
+
+// blobLock returns mutex serializing creation and removal of blob files
+// with specified hash. Blob files are created and removed only after
+// transaction that changes reference counter is committed, so counter
+// row can't be used for that.
+func (s *Server) blobLock(hash string) *sync.Mutex {
+	stripe := 0
+	if len(hash) >= 2 {
+		b, _ := strconv.ParseUint(hash[:2], 16, 8)
+		stripe = int(b)
+	}
+	return &s.blobLocks[stripe%len(s.blobLocks)]
+}
+
+// addBlobFile adds DB entry for file whose contents is already written
+// to tempPath, storing contents as deduplicated blob.
+//
+// tempPath is always removed or moved into blobs directory.
+func (s *Server) addBlobFile(tempPath string, info FileInfo) error {
+	defer os.Remove(tempPath) // no-op if moved
+
+	info.blob = info.SHA256
+	blobPath := s.storagePath(info)
+
+	lock := s.blobLock(info.blob)
+	lock.Lock()
+	var created bool
+	var err error
+	for i := 0; i < blobTxRetries; i++ {
+		created, err = s.tryAddBlobFile(info)
+		if err == nil {
+			break
+		}
+		s.dbgLog("Blob transaction failed, retrying:", err)
+		time.Sleep(time.Duration(i+1) * 10 * time.Millisecond)
+	}
+	if err == nil && created {
+		// Temporary file is kept until commit, so failed transaction
+		// never touches blob of other files.
+		err = os.Rename(tempPath, blobPath)
+		if err != nil {
+			err = errors.Wrap(err, "blob rename")
+			lock.Unlock()
+			if rmErr := s.removeFile(info.UUID); rmErr != nil {
+				s.Logger.Printf("DB remove failure (%v): %v\n", info.UUID, rmErr)
+			}
+			return err
+		}
+	}
+	lock.Unlock()
+	return err
+}
+
+// tryAddBlobFile adds DB entry for file and reference to its blob.
+// created is true if blob file should be created.
+func (s *Server) tryAddBlobFile(info FileInfo) (created bool, err error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return false, errors.Wrap(err, "tx begin")
+	}
+	defer tx.Rollback() // rollback is no-op after commit
+
+	created, err = s.DB.AcquireBlob(tx, info.blob)
+	if err != nil {
+		return false, errors.Wrap(err, "blob acquire")
+	}
+	if err := s.DB.AddFile(tx, info); err != nil {
+		return false, errors.Wrap(err, "db add")
+	}
+	if err := tx.Commit(); err != nil {
+		return false, errors.Wrap(err, "tx commit")
+	}
+	return created, nil
+}
+
+// releaseContents releases stored file contents. For deduplicated files
+// reference to blob is removed and remove is true only if it was the last
+// one.
+//
+// Should be called in the same transaction as DB entry removal. Contents
+// should be removed using removeContents after commit.
+func (s *Server) releaseContents(tx *sql.Tx, info FileInfo) (remove bool, err error) {
+	if info.blob == "" {
+		return true, nil
+	}
+	removed, err := s.DB.ReleaseBlob(tx, info.blob)
+	if err != nil {
+		return false, errors.Wrap(err, "blob release")
+	}
+	if !removed {
+		s.dbgLog("Blob", info.blob, "is still referenced, keeping it")
+	}
+	return removed, nil
+}
+
+// removeContents removes stored file contents released by
+// releaseContents. Blob is kept if it was acquired again since release.
+func (s *Server) removeContents(info FileInfo) error {
+	if info.blob != "" {
+		lock := s.blobLock(info.blob)
+		lock.Lock()
+		defer lock.Unlock()
+
+		exists, err := s.DB.BlobExists(info.blob)
+		if err != nil {
+			return errors.Wrap(err, "blob query")
+		}
+		if exists {
+			s.dbgLog("Blob", info.blob, "is acquired again, keeping it")
+			return nil
+		}
+	}
+
+	if err := os.Remove(s.storagePath(info)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
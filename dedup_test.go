@@ -0,0 +1,190 @@
+package filedrop_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/filedrop"
+)
+
+func countBlobs(t *testing.T, serv *filedrop.Server) int {
+	t.Helper()
+
+	entries, err := ioutil.ReadDir(filepath.Join(serv.Conf.StorageDir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestDedup(t *testing.T) {
+	conf := filedrop.Default
+	conf.Dedup = true
+	serv := initServ(conf)
+	defer cleanServ(serv)
+
+	first, err := serv.AddFile(strings.NewReader(file), "text/plain", 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := serv.AddFile(strings.NewReader(file), "text/kitteh", 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("Same UUID assigned to both files")
+	}
+	if _, err := serv.AddFile(strings.NewReader("other"), "text/plain", 0, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if blobs := countBlobs(t, serv); blobs != 2 {
+		t.Error("Wrong amount of blobs:", blobs)
+	}
+
+	for _, fileUUID := range []string{first, second} {
+		r, err := serv.OpenFile(fileUUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(r)
+		if string(body) != file {
+			t.Error("Got different file!")
+		}
+	}
+
+	if err := serv.RemoveFile(first); err != nil {
+		t.Fatal(err)
+	}
+	if blobs := countBlobs(t, serv); blobs != 2 {
+		t.Error("Blob removed while still referenced")
+	}
+	if _, err := serv.OpenFile(second); err != nil {
+		t.Error("File unavailable after removal of duplicate:", err)
+	}
+
+	if err := serv.RemoveFile(second); err != nil {
+		t.Fatal(err)
+	}
+	if blobs := countBlobs(t, serv); blobs != 1 {
+		t.Error("Blob not removed after last reference is gone")
+	}
+}
+
+func TestDedupCleanup(t *testing.T) {
+	conf := filedrop.Default
+	conf.Dedup = true
+	conf.CleanupIntervalSecs = 1
+	serv := initServ(conf)
+	defer cleanServ(serv)
+
+	if _, err := serv.AddFile(strings.NewReader(file), "text/plain", 0, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	kept, err := serv.AddFile(strings.NewReader(file), "text/plain", 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(3 * time.Second)
+
+	if blobs := countBlobs(t, serv); blobs != 1 {
+		t.Error("Blob removed while still referenced")
+	}
+	if _, err := serv.OpenFile(kept); err != nil {
+		t.Error("File unavailable after clean-up of duplicate:", err)
+	}
+}
+
+func TestDedupConcurrent(t *testing.T) {
+	conf := filedrop.Default
+	conf.Dedup = true
+	serv := initServ(conf)
+	defer cleanServ(serv)
+
+	// Uploads and removals of the same contents race with each other,
+	// remaining files should be readable.
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	remaining := []string{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				fileUUID, err := serv.AddFile(strings.NewReader(file), "text/plain", 0, time.Time{})
+				if err != nil {
+					t.Error("AddFile:", err)
+					return
+				}
+				if (i+j)%2 == 0 {
+					if err := serv.RemoveFile(fileUUID); err != nil {
+						t.Error("RemoveFile:", err)
+					}
+					continue
+				}
+				lock.Lock()
+				remaining = append(remaining, fileUUID)
+				lock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, fileUUID := range remaining {
+		r, err := serv.OpenFile(fileUUID)
+		if err != nil {
+			t.Fatal("File", fileUUID, "unavailable:", err)
+		}
+		body, _ := ioutil.ReadAll(r)
+		if string(body) != file {
+			t.Fatal("Got different file!")
+		}
+	}
+
+	for i, fileUUID := range remaining {
+		if err := serv.RemoveFile(fileUUID); err != nil {
+			t.Fatal("RemoveFile "+strconv.Itoa(i)+":", err)
+		}
+	}
+	if blobs := countBlobs(t, serv); blobs != 0 {
+		t.Error("Blob not removed after last reference is gone")
+	}
+}
+
+func TestDedupReupload(t *testing.T) {
+	conf := filedrop.Default
+	conf.Dedup = true
+	serv := initServ(conf)
+	defer cleanServ(serv)
+
+	// Blob file is removed after last reference is gone and created
+	// again by next upload of the same contents.
+	for i := 0; i < 3; i++ {
+		fileUUID, err := serv.AddFile(strings.NewReader(file), "text/plain", 0, time.Time{})
+		if err != nil {
+			t.Fatal("AddFile:", err)
+		}
+		if blobs := countBlobs(t, serv); blobs != 1 {
+			t.Fatal("Wrong blobs count after upload:", blobs)
+		}
+		r, err := serv.OpenFile(fileUUID)
+		if err != nil {
+			t.Fatal("File unavailable:", err)
+		}
+		body, _ := ioutil.ReadAll(r)
+		if string(body) != file {
+			t.Fatal("Got different file!")
+		}
+		if err := serv.RemoveFile(fileUUID); err != nil {
+			t.Fatal("RemoveFile:", err)
+		}
+		if blobs := countBlobs(t, serv); blobs != 0 {
+			t.Fatal("Blob not removed after last reference is gone")
+		}
+	}
+}
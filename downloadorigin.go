@@ -0,0 +1,12 @@
+package filedrop
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isDownloadHost checks whether request is made to host of
+// Config.DownloadURL.
+func (s *Server) isDownloadHost(r *http.Request) bool {
+	return s.downloadURL != nil && strings.EqualFold(s.requestHost(r), s.downloadURL.Host)
+}
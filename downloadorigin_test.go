@@ -0,0 +1,91 @@
+package filedrop_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/filedrop"
+)
+
+func doWithHost(t *testing.T, c *http.Client, method, url, host string, body io.Reader) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	req.Header.Set("Accept", "text/html")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, respBody
+}
+
+func TestDownloadOrigin(t *testing.T) {
+	conf := filedrop.Default
+	conf.DownloadURL = "https://files.example.org/d/"
+	conf.UploadPage = true
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	if !strings.HasPrefix(url, "https://files.example.org/d/") {
+		t.Fatal("Wrong file URL:", url)
+	}
+	path := strings.TrimPrefix(url, "https://files.example.org")
+
+	t.Run("download", func(t *testing.T) {
+		resp, body := doWithHost(t, c, "GET", ts.URL+path, "files.example.org", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("GET: HTTP", resp.StatusCode, resp.Status)
+		}
+		if string(body) != file {
+			t.Error("Got different file!")
+		}
+	})
+	t.Run("download from upload host", func(t *testing.T) {
+		if code := doGETFail(t, c, ts.URL+path); code != http.StatusForbidden {
+			t.Error("GET: HTTP", code)
+		}
+	})
+	t.Run("upload to download host", func(t *testing.T) {
+		resp, _ := doWithHost(t, c, "POST", ts.URL+"/d", "files.example.org", strings.NewReader(file))
+		if resp.StatusCode != http.StatusForbidden {
+			t.Error("POST: HTTP", resp.StatusCode, resp.Status)
+		}
+	})
+	t.Run("upload page on download host", func(t *testing.T) {
+		resp, _ := doWithHost(t, c, "GET", ts.URL+"/d", "files.example.org", nil)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Error("GET: HTTP", resp.StatusCode, resp.Status)
+		}
+		resp, _ = doWithHost(t, c, "GET", ts.URL+"/filedrop", "uploads.example.org", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Error("GET: HTTP", resp.StatusCode, resp.Status)
+		}
+	})
+}
+
+func TestDownloadOriginInvalid(t *testing.T) {
+	for _, downloadURL := range []string{"files.example.org", "ftp://files.example.org", "https://files.example.org/?a=b"} {
+		conf := filedrop.Default
+		conf.DownloadURL = downloadURL
+		if _, err := filedrop.New(conf); err == nil {
+			t.Error("No error for", downloadURL)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package filedrop
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EncryptionE2E is a FileInfo.Encryption value for files encrypted by
+// client before upload ("encryption=e2e" query parameter).
+//
+// Such files use the same chunked format as encryption at rest (see
+// encryption.go), the key is never sent to the server. Built-in pages
+// carry it in URL fragment, see E2EFragment.
+const EncryptionE2E = "e2e"
+
+// GenerateE2EKey returns new random key for client-side encryption.
+func GenerateE2EKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// NewE2EWriter returns io.WriteCloser that encrypts data written to it
+// using key and writes result to w. Close must be called after all data is
+// written, it doesn't closes w.
+func NewE2EWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	return newEncryptingWriter(w, key)
+}
+
+// NewE2EReader returns io.ReadSeeker that decrypts size bytes read from r
+// encrypted by NewE2EWriter or built-in upload page.
+//
+// Decryption errors (including modified data) are returned by Read.
+func NewE2EReader(r io.ReaderAt, size int64, key []byte) (io.ReadSeeker, error) {
+	return newDecryptingReader(r, size, key)
+}
+
+// E2EFragment returns URL fragment (without leading #) used by built-in
+// pages to carry key and original file name (may be empty).
+func E2EFragment(key []byte, name string) string {
+	fragment := base64.RawURLEncoding.EncodeToString(key)
+	if name != "" {
+		fragment += "/" + url.PathEscape(name)
+	}
+	return fragment
+}
+
+// ParseE2EFragment is a reverse of E2EFragment.
+func ParseE2EFragment(fragment string) (key []byte, name string, err error) {
+	parts := strings.SplitN(fragment, "/", 2)
+	key, err = base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, "", errors.Wrap(err, "key decode")
+	}
+	if len(key) != 32 {
+		return nil, "", errors.New("key should be 256 bits long")
+	}
+	if len(parts) == 2 {
+		name, err = url.PathUnescape(parts[1])
+		if err != nil {
+			return nil, "", errors.Wrap(err, "name decode")
+		}
+	}
+	return key, name, nil
+}
+
+// isE2EPageRequest checks whether browser navigates to client-side
+// encrypted file so decryption page should be served instead of
+// contents. Page fetches contents using "raw" query parameter.
+func isE2EPageRequest(r *http.Request, info FileInfo) bool {
+	return info.Encryption == EncryptionE2E && isBrowserNavigation(r)
+}
+
+func writePage(w http.ResponseWriter, page string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'; img-src blob:")
+	io.WriteString(w, page)
+}
+
+func (s *Server) serveE2EUploadPage(w http.ResponseWriter, r *http.Request) {
+	writePage(w, e2eUploadPage)
+}
+
+func (s *Server) serveE2EDownloadPage(w http.ResponseWriter, r *http.Request) {
+	writePage(w, e2eDownloadPage)
+}
+
+// JavaScript implementation of encryption format, shared by both pages.
+const e2eScript = `
+const CHUNK = 65536;
+const MAGIC = [0x46, 0x44, 0x45, 0x4e, 0x43, 0x00, 0x00, 0x01];
+const HEADER_LEN = 19;
+
+function chunkNonce(prefix, index, last) {
+	const nonce = new Uint8Array(12);
+	nonce.set(prefix);
+	new DataView(nonce.buffer).setUint32(7, index);
+	nonce[11] = last ? 1 : 0;
+	return nonce;
+}
+
+function encodeKey(key) {
+	let s = '';
+	key.forEach(b => { s += String.fromCharCode(b); });
+	return btoa(s).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+function decodeKey(s) {
+	s = s.replace(/-/g, '+').replace(/_/g, '/');
+	while (s.length % 4) s += '=';
+	return Uint8Array.from(atob(s), c => c.charCodeAt(0));
+}
+
+async function encrypt(data, rawKey) {
+	const key = await crypto.subtle.importKey('raw', rawKey, 'AES-GCM', false, ['encrypt']);
+	const header = new Uint8Array(HEADER_LEN);
+	header.set(MAGIC);
+	new DataView(header.buffer).setUint32(8, CHUNK);
+	const prefix = crypto.getRandomValues(new Uint8Array(7));
+	header.set(prefix, 12);
+
+	const parts = [header];
+	const chunks = Math.max(1, Math.ceil(data.byteLength / CHUNK));
+	for (let i = 0; i < chunks; i++) {
+		const params = {name: 'AES-GCM', iv: chunkNonce(prefix, i, i === chunks - 1), additionalData: header};
+		parts.push(await crypto.subtle.encrypt(params, key, data.slice(i * CHUNK, (i + 1) * CHUNK)));
+	}
+	return new Blob(parts);
+}
+
+async function decrypt(data, rawKey) {
+	const bytes = new Uint8Array(data);
+	const header = bytes.slice(0, HEADER_LEN);
+	if (bytes.length < HEADER_LEN || MAGIC.some((b, i) => header[i] !== b)) {
+		throw new Error('not an encrypted file');
+	}
+	const chunkSize = new DataView(header.buffer).getUint32(8);
+	const prefix = header.slice(12);
+	const key = await crypto.subtle.importKey('raw', rawKey, 'AES-GCM', false, ['decrypt']);
+
+	const body = bytes.subarray(HEADER_LEN);
+	const sealed = chunkSize + 16;
+	const chunks = Math.ceil(body.length / sealed);
+	if (chunks === 0) {
+		throw new Error('truncated file');
+	}
+	const parts = [];
+	for (let i = 0; i < chunks; i++) {
+		const params = {name: 'AES-GCM', iv: chunkNonce(prefix, i, i === chunks - 1), additionalData: header};
+		parts.push(await crypto.subtle.decrypt(params, key, body.subarray(i * sealed, (i + 1) * sealed)));
+	}
+	return new Blob(parts);
+}
+`
+
+const e2eUploadPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>filedrop</title>
+<style>body { font-family: sans-serif; max-width: 40em; margin: 2em auto; } #link { word-break: break-all; }</style>
+</head>
+<body>
+<h1>Send encrypted file</h1>
+<p>File is encrypted in your browser, server never sees the key.</p>
+<form id="form">
+<p><input type="file" id="file" required></p>
+<p><label>Max downloads: <input type="number" id="max-uses" min="1"></label></p>
+<p><button type="submit">Upload</button></p>
+</form>
+<p id="status"></p>
+<p><a id="link"></a></p>
+<script>` + e2eScript + `
+document.getElementById('form').addEventListener('submit', async ev => {
+	ev.preventDefault();
+	const status = document.getElementById('status');
+	const file = document.getElementById('file').files[0];
+	try {
+		status.textContent = 'Encrypting...';
+		const rawKey = crypto.getRandomValues(new Uint8Array(32));
+		const body = await encrypt(await file.arrayBuffer(), rawKey);
+
+		status.textContent = 'Uploading...';
+		let target = location.pathname + '?encryption=e2e';
+		const maxUses = document.getElementById('max-uses').value;
+		if (maxUses) {
+			target += '&max-uses=' + encodeURIComponent(maxUses);
+		}
+		const resp = await fetch(target, {method: 'POST', headers: {'Content-Type': 'application/octet-stream'}, body: body});
+		if (!resp.ok) {
+			throw new Error('HTTP ' + resp.status + ': ' + await resp.text());
+		}
+		const link = (await resp.text()) + '#' + encodeKey(rawKey) + '/' + encodeURIComponent(file.name);
+		status.textContent = 'Done, share this link:';
+		document.getElementById('link').textContent = link;
+		document.getElementById('link').href = link;
+	} catch (e) {
+		status.textContent = 'Upload failed: ' + e.message;
+	}
+});
+</script>
+</body>
+</html>
+`
+
+const e2eDownloadPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>filedrop</title>
+<style>body { font-family: sans-serif; max-width: 40em; margin: 2em auto; }</style>
+</head>
+<body>
+<h1>Encrypted file</h1>
+<p id="status">Decrypting...</p>
+<p><a id="link"></a></p>
+<script>` + e2eScript + `
+(async () => {
+	const status = document.getElementById('status');
+	try {
+		const fragment = location.hash.slice(1);
+		if (!fragment) {
+			throw new Error('key is missing in URL');
+		}
+		const sep = fragment.indexOf('/');
+		const rawKey = decodeKey(sep === -1 ? fragment : fragment.slice(0, sep));
+		const name = sep === -1 ? 'download' : decodeURIComponent(fragment.slice(sep + 1));
+
+		const resp = await fetch(location.pathname + '?raw=1');
+		if (!resp.ok) {
+			throw new Error('HTTP ' + resp.status);
+		}
+		const blob = await decrypt(await resp.arrayBuffer(), rawKey);
+
+		const link = document.getElementById('link');
+		link.href = URL.createObjectURL(blob);
+		link.download = name;
+		link.textContent = 'Save ' + name;
+		status.textContent = 'File decrypted.';
+		link.click();
+	} catch (e) {
+		status.textContent = 'Decryption failed: ' + e.message;
+	}
+})();
+</script>
+</body>
+</html>
+`
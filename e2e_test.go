@@ -0,0 +1,171 @@
+package filedrop_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/filedrop"
+)
+
+func e2eEncrypt(t *testing.T, key []byte, contents string) []byte {
+	t.Helper()
+
+	buf := bytes.Buffer{}
+	w, err := filedrop.NewE2EWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func getHTML(t *testing.T, c *http.Client, url string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestE2EUpload(t *testing.T) {
+	conf := filedrop.Default
+	conf.Limits.MaxUses = 1
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	key, err := filedrop.GenerateE2EKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := e2eEncrypt(t, key, file)
+	url := string(doPOST(t, c, ts.URL+"/filedrop?encryption=e2e", "application/octet-stream", bytes.NewReader(ciphertext)))
+	splittenURL := strings.Split(url, "/")
+	fileUUID := splittenURL[len(splittenURL)-1]
+
+	info, err := serv.FileInfo(fileUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Encryption != filedrop.EncryptionE2E {
+		t.Error("Wrong encryption mode:", info.Encryption)
+	}
+
+	t.Run("decryption page", func(t *testing.T) {
+		resp := getHTML(t, c, url)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != 200 {
+			t.Fatal("GET: HTTP", resp.StatusCode)
+		}
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+			t.Error("Wrong Content-Type:", resp.Header.Get("Content-Type"))
+		}
+		if !strings.Contains(string(body), "crypto.subtle.decrypt") {
+			t.Error("Decryption page is not served")
+		}
+		if info, _ := serv.FileInfo(fileUUID); info.Uses != 0 {
+			t.Error("Decryption page counted as use")
+		}
+	})
+	t.Run("raw contents", func(t *testing.T) {
+		stored := doGET(t, c, url+"?raw=1")
+		if !bytes.Equal(stored, ciphertext) {
+			t.Fatal("Got different ciphertext")
+		}
+		r, err := filedrop.NewE2EReader(bytes.NewReader(stored), int64(len(stored)), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(plaintext) != file {
+			t.Error("Got different file!")
+		}
+	})
+}
+
+func TestE2EInvalidMode(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	if code := doPOSTFail(t, c, ts.URL+"/filedrop?encryption=rot13", "text/plain", strings.NewReader(file)); code != 400 {
+		t.Error("POST: HTTP", code)
+	}
+}
+
+func TestE2EPlainFileNoPage(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	resp := getHTML(t, c, url)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != file {
+		t.Error("Got different file!")
+	}
+}
+
+func TestE2EUploadPage(t *testing.T) {
+	conf := filedrop.Default
+	conf.E2EPagePath = "/send"
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	body := string(doGET(t, c, ts.URL+"/send"))
+	if !strings.Contains(body, "crypto.subtle.encrypt") {
+		t.Error("Upload page is not served")
+	}
+}
+
+func TestE2EFragment(t *testing.T) {
+	key, err := filedrop.GenerateE2EKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fragment := filedrop.E2EFragment(key, "cat photo #1.png")
+	if strings.Contains(fragment, " ") {
+		t.Error("Fragment is not escaped:", fragment)
+	}
+
+	parsedKey, name, err := filedrop.ParseE2EFragment(fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsedKey, key) {
+		t.Error("Got different key")
+	}
+	if name != "cat photo #1.png" {
+		t.Error("Got different name:", name)
+	}
+}
@@ -0,0 +1,466 @@
+package filedrop
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Encrypted file format
+//
+// Files are encrypted using AES-256-GCM in chunks, so arbitrary byte range
+// can be decrypted without reading whole file (STREAM construction):
+//
+//   header: magic (8 bytes) | chunk size (4 bytes, BE) | nonce prefix (7 bytes)
+//   chunks: ciphertext+tag of each plaintext chunk, last one can be shorter
+//
+// Nonce for chunk N is nonce prefix | N (4 bytes, BE) | 1 if chunk is last,
+// otherwise 0. Header is used as additional authenticated data for each
+// chunk. This prevents reordering, truncation and header modification.
+//
+// Each file is encrypted using random data key which is stored in database
+// wrapped (AES-256-GCM encrypted) using master key.
+
+const (
+	encMagic          = "FDENC\x00\x00\x01"
+	encChunkSize      = 64 * 1024
+	encNoncePrefixLen = 7
+	encHeaderLen      = len(encMagic) + 4 + encNoncePrefixLen
+	encTagLen         = 16
+
+	// Wrapped key format: version (1 byte) | master key ID (4 bytes) | nonce (12 bytes) | ciphertext+tag
+	wrapVersion  = 1
+	keyIDLen     = 4
+	wrapNonceLen = 12
+)
+
+var ErrWrongMasterKey = errors.New("data key is wrapped using different master key")
+
+// parseKey decodes 256-bit key in hex or base64 encoding.
+func parseKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.New("key should be hex or base64 encoded")
+		}
+	}
+	if len(key) != 32 {
+		return nil, errors.New("key should be 256 bits long")
+	}
+	return key, nil
+}
+
+// ReadKeyFile reads 256-bit key in hex or base64 encoding from file.
+func ReadKeyFile(path string) ([]byte, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseKey(string(blob))
+}
+
+// Enabled reports whether encryption at rest is configured.
+func (c EncryptionConfig) Enabled() bool {
+	return c.MasterKey != "" || c.MasterKeyFile != ""
+}
+
+// Key returns master key specified in configuration.
+func (c EncryptionConfig) Key() ([]byte, error) {
+	if c.MasterKeyFile != "" {
+		return ReadKeyFile(c.MasterKeyFile)
+	}
+	return parseKey(c.MasterKey)
+}
+
+func keyID(masterKey []byte) []byte {
+	hash := sha256.Sum256(masterKey)
+	return hash[:keyIDLen]
+}
+
+// wrapKey encrypts data key using master key. fileUUID is authenticated
+// together with key so wrapped key can't be reused for other file.
+func wrapKey(masterKey, dataKey []byte, fileUUID string) (string, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return "", err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	res := make([]byte, 1+keyIDLen+wrapNonceLen, 1+keyIDLen+wrapNonceLen+len(dataKey)+encTagLen)
+	res[0] = wrapVersion
+	copy(res[1:], keyID(masterKey))
+	nonce := res[1+keyIDLen:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	res = aead.Seal(res, nonce, dataKey, []byte(fileUUID))
+	return base64.StdEncoding.EncodeToString(res), nil
+}
+
+func unwrapKey(masterKey []byte, wrapped string, fileUUID string) ([]byte, error) {
+	blob, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, errors.Wrap(err, "wrapped key decode")
+	}
+	if len(blob) < 1+keyIDLen+wrapNonceLen+encTagLen || blob[0] != wrapVersion {
+		return nil, errors.New("malformed wrapped key")
+	}
+	if string(blob[1:1+keyIDLen]) != string(keyID(masterKey)) {
+		return nil, ErrWrongMasterKey
+	}
+
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := blob[1+keyIDLen : 1+keyIDLen+wrapNonceLen]
+	return aead.Open(nil, nonce, blob[1+keyIDLen+wrapNonceLen:], []byte(fileUUID))
+}
+
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encNoncePrefixLen:], index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptingWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+	index  uint32
+	buf    []byte
+}
+
+// newEncryptingWriter writes header to w and returns io.WriteCloser that
+// encrypts data written to it. Close should be called to write the
+// last chunk, it doesn't closes w.
+func newEncryptingWriter(w io.Writer, dataKey []byte) (io.WriteCloser, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, encHeaderLen)
+	copy(header, encMagic)
+	binary.BigEndian.PutUint32(header[len(encMagic):], encChunkSize)
+	prefix := header[len(encMagic)+4:]
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &encryptingWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		prefix: prefix,
+		buf:    make([]byte, 0, encChunkSize),
+	}, nil
+}
+
+func (ew *encryptingWriter) flush(last bool) error {
+	sealed := ew.aead.Seal(nil, chunkNonce(ew.prefix, ew.index, last), ew.buf, ew.header)
+	ew.index++
+	ew.buf = ew.buf[:0]
+	_, err := ew.w.Write(sealed)
+	return err
+}
+
+func (ew *encryptingWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) != 0 {
+		// Full chunk is flushed only when there is more data, since we
+		// don't know whether it is last before that.
+		if len(ew.buf) == encChunkSize {
+			if err := ew.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(ew.buf[len(ew.buf):encChunkSize], b)
+		ew.buf = ew.buf[:len(ew.buf)+n]
+		b = b[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (ew *encryptingWriter) Close() error {
+	return ew.flush(true)
+}
+
+type readSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+type decryptingReader struct {
+	r      io.ReaderAt
+	closer io.Closer
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+
+	chunkSize int64
+	bodySize  int64
+	chunks    int64
+	size      int64
+
+	pos        int64
+	chunkIndex int64
+	chunk      []byte
+}
+
+// newDecryptingReader returns reader that decrypts size bytes from r
+// encrypted by encryptingWriter. If r implements io.Closer then closing
+// reader closes r.
+func newDecryptingReader(r io.ReaderAt, size int64, dataKey []byte) (*decryptingReader, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, encHeaderLen)
+	if size < int64(encHeaderLen) {
+		return nil, errors.New("truncated file")
+	}
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, errors.Wrap(err, "header read")
+	}
+	if string(header[:len(encMagic)]) != encMagic {
+		return nil, errors.New("not an encrypted file")
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(header[len(encMagic):]))
+	if chunkSize == 0 {
+		return nil, errors.New("malformed header")
+	}
+
+	bodySize := size - int64(encHeaderLen)
+	sealedChunk := chunkSize + encTagLen
+	chunks := (bodySize + sealedChunk - 1) / sealedChunk
+	if bodySize <= 0 || bodySize-(chunks-1)*sealedChunk < encTagLen {
+		return nil, errors.New("truncated file")
+	}
+
+	closer, _ := r.(io.Closer)
+	return &decryptingReader{
+		r:          r,
+		closer:     closer,
+		aead:       aead,
+		header:     header,
+		prefix:     header[len(encMagic)+4:],
+		chunkSize:  chunkSize,
+		bodySize:   bodySize,
+		chunks:     chunks,
+		size:       bodySize - chunks*encTagLen,
+		chunkIndex: -1,
+	}, nil
+}
+
+// Size returns size of decrypted contents.
+func (dr *decryptingReader) Size() int64 {
+	return dr.size
+}
+
+func (dr *decryptingReader) loadChunk(index int64) error {
+	sealedChunk := dr.chunkSize + encTagLen
+	offset := index * sealedChunk
+	length := sealedChunk
+	if offset+length > dr.bodySize {
+		length = dr.bodySize - offset
+	}
+
+	sealed := make([]byte, length)
+	if _, err := dr.r.ReadAt(sealed, int64(encHeaderLen)+offset); err != nil {
+		return errors.Wrap(err, "chunk read")
+	}
+	nonce := chunkNonce(dr.prefix, uint32(index), index == dr.chunks-1)
+	chunk, err := dr.aead.Open(sealed[:0], nonce, sealed, dr.header)
+	if err != nil {
+		return errors.Wrap(err, "chunk decrypt")
+	}
+	dr.chunk = chunk
+	dr.chunkIndex = index
+	return nil
+}
+
+func (dr *decryptingReader) Read(b []byte) (int, error) {
+	if dr.pos >= dr.size {
+		return 0, io.EOF
+	}
+
+	index := dr.pos / dr.chunkSize
+	if index != dr.chunkIndex {
+		if err := dr.loadChunk(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, dr.chunk[dr.pos%dr.chunkSize:])
+	dr.pos += int64(n)
+	return n, nil
+}
+
+func (dr *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = dr.pos + offset
+	case io.SeekEnd:
+		pos = dr.size + offset
+	default:
+		return dr.pos, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return dr.pos, errors.New("negative position")
+	}
+	dr.pos = pos
+	return pos, nil
+}
+
+func (dr *decryptingReader) Close() error {
+	if dr.closer == nil {
+		return nil
+	}
+	return dr.closer.Close()
+}
+
+// openStored opens stored file representation for reading, decrypting it
+// if necessary. Returned size is the size of decrypted representation,
+// it is compressed if info.compression is set.
+func (s *Server) openStored(info FileInfo) (readSeekCloser, int64, error) {
+	file, err := os.Open(s.storagePath(info))
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, errors.Wrap(err, "file stat")
+	}
+
+	if info.dataKey == "" {
+		return file, stat.Size(), nil
+	}
+
+	if s.masterKey == nil {
+		file.Close()
+		return nil, 0, errors.New("file is encrypted but master key is not configured")
+	}
+	dataKey, err := unwrapKey(s.masterKey, info.dataKey, info.UUID)
+	if err != nil {
+		file.Close()
+		return nil, 0, errors.Wrap(err, "data key unwrap")
+	}
+	reader, err := newDecryptingReader(file, stat.Size(), dataKey)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return reader, reader.Size(), nil
+}
+
+// openContents opens file contents for reading, decrypting and
+// decompressing it if necessary.
+func (s *Server) openContents(info FileInfo) (readSeekCloser, error) {
+	file, _, err := s.openStored(info)
+	if err != nil {
+		return nil, err
+	}
+	if info.compression != "" {
+		return newDecompressingReader(file, info.compression, info.Size), nil
+	}
+	return file, nil
+}
+
+// RotateKey re-wraps data keys of all encrypted files using newKey. Files
+// contents are not changed.
+//
+// Server should be stopped before rotation and started using new key
+// after it, otherwise files uploaded in between will be unreadable.
+func RotateKey(conf Config, newKey []byte) (int, error) {
+	if len(newKey) != 32 {
+		return 0, errors.New("key should be 256 bits long")
+	}
+	oldKey, err := conf.Encryption.Key()
+	if err != nil {
+		return 0, errors.Wrap(err, "master key")
+	}
+
+	db, err := openDB(conf.DB.Driver, conf.DB.DSN)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "tx begin")
+	}
+	defer tx.Rollback() // rollback is no-op after commit
+
+	keys, err := db.DataKeys(tx)
+	if err != nil {
+		return 0, errors.Wrap(err, "data keys query")
+	}
+	rotated := 0
+	for fileUUID, wrapped := range keys {
+		dataKey, err := unwrapKey(oldKey, wrapped, fileUUID)
+		if err == ErrWrongMasterKey {
+			// Maybe already rotated by interrupted run.
+			if _, err := unwrapKey(newKey, wrapped, fileUUID); err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			return 0, errors.Wrapf(err, "data key unwrap (%v)", fileUUID)
+		}
+		rewrapped, err := wrapKey(newKey, dataKey, fileUUID)
+		if err != nil {
+			return 0, errors.Wrap(err, "data key wrap")
+		}
+		if err := db.SetDataKey(tx, fileUUID, rewrapped); err != nil {
+			return 0, errors.Wrap(err, "data key update")
+		}
+		rotated++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "tx commit")
+	}
+	return rotated, nil
+}
@@ -0,0 +1,200 @@
+package filedrop_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/filedrop"
+)
+
+func genKey(t *testing.T) string {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(key)
+}
+
+func TestEncryption(t *testing.T) {
+	conf := filedrop.Default
+	conf.Encryption.MasterKey = genKey(t)
+	serv := initServ(conf)
+	defer cleanServ(serv)
+
+	for _, size := range []int{0, 10, 64 * 1024, 64*1024 + 1, 200 * 1000} {
+		contents := make([]byte, size)
+		io.ReadFull(rand.Reader, contents)
+
+		fileUUID, err := serv.AddFile(bytes.NewReader(contents), "application/octet-stream", 0, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := ioutil.ReadFile(filepath.Join(serv.Conf.StorageDir, fileUUID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != 0 && bytes.Contains(stored, contents) {
+			t.Error("File is stored in plaintext, size:", size)
+		}
+
+		r, err := serv.OpenFile(fileUUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, contents) {
+			t.Error("Got different file, size:", size)
+		}
+	}
+}
+
+func TestEncryptionRange(t *testing.T) {
+	conf := filedrop.Default
+	conf.Encryption.MasterKey = genKey(t)
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	contents := make([]byte, 200*1000)
+	io.ReadFull(rand.Reader, contents)
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "application/octet-stream", bytes.NewReader(contents)))
+
+	if body := doGET(t, c, url); !bytes.Equal(body, contents) {
+		t.Error("Got different file")
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Crosses chunk boundary.
+	req.Header.Set("Range", "bytes=65000-70000")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatal("GET: HTTP", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, contents[65000:70001]) {
+		t.Error("Got different range")
+	}
+}
+
+func TestEncryptionTampered(t *testing.T) {
+	conf := filedrop.Default
+	conf.Encryption.MasterKey = genKey(t)
+	serv := initServ(conf)
+	defer cleanServ(serv)
+
+	fileUUID, err := serv.AddFile(strings.NewReader(file), "text/plain", 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(serv.Conf.StorageDir, fileUUID)
+	stored, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored[len(stored)-1] ^= 1
+	if err := ioutil.WriteFile(path, stored, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := serv.OpenFile(fileUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("Modified file decrypted without errors")
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	conf := filedrop.Default
+	conf.Encryption.MasterKey = genKey(t)
+	serv := initServ(conf)
+	defer cleanServ(serv)
+
+	fileUUID, err := serv.AddFile(strings.NewReader(file), "text/plain", 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey := genKey(t)
+	keyFile := filepath.Join(serv.Conf.StorageDir, "new.key")
+	if err := ioutil.WriteFile(keyFile, []byte(newKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile)
+	newKeyBlob, err := filedrop.ReadKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := filedrop.RotateKey(serv.Conf, newKeyBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated != 1 {
+		t.Error("Wrong amount of rotated keys:", rotated)
+	}
+
+	if _, err := serv.OpenFile(fileUUID); err == nil {
+		t.Error("File opened using old master key")
+	}
+
+	newConf := serv.Conf
+	newConf.Encryption.MasterKey = newKey
+	newServ, err := filedrop.New(newConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newServ.Close()
+
+	r, err := newServ.OpenFile(fileUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != file {
+		t.Error("Got different file!")
+	}
+}
+
+func TestEncryptionWithDedup(t *testing.T) {
+	conf := filedrop.Default
+	conf.Encryption.MasterKey = genKey(t)
+	conf.Dedup = true
+	conf.StorageDir = "/nonexistent"
+	if _, err := filedrop.New(conf); err == nil {
+		t.Error("Dedup and encryption enabled together")
+	}
+}
@@ -0,0 +1,141 @@
+package filedrop
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type EventType string
+
+const (
+	// EventUploaded is published after file is successfully stored.
+	EventUploaded EventType = "uploaded"
+
+	// EventDownloaded is published after each access counted as a "use".
+	EventDownloaded EventType = "downloaded"
+
+	// EventExhausted is published when file reaches its max-uses limit.
+	EventExhausted EventType = "exhausted"
+
+	// EventExpired is published when file is removed because its store
+	// time passed. It is always followed by EventDeleted.
+	EventExpired EventType = "expired"
+
+	// EventDeleted is published after file is removed from storage for
+	// any reason.
+	EventDeleted EventType = "deleted"
+)
+
+// FileInfo contains file meta-information as stored in database.
+type FileInfo struct {
+	UUID        string
+	ContentType string
+	Uses        uint
+	// MaxUses is zero if there is no limit.
+	MaxUses uint
+	// StoreUntil is zero if there is no limit.
+	StoreUntil time.Time
+
+	// Size is file size in bytes, -1 if unknown (file was uploaded
+	// by older version).
+	Size int64
+	// SHA256 is a hex-encoded SHA-256 hash of file contents, empty if unknown.
+	SHA256 string
+	// CreatedAt is upload time, zero if unknown.
+	CreatedAt time.Time
+
+	// Encryption is EncryptionE2E if contents was encrypted by client
+	// before upload, empty otherwise.
+	Encryption string
+
+	// Sanitized is true if metadata (EXIF, XMP, etc.) was stripped from
+	// image on upload.
+	Sanitized bool
+
+	// blob is a hash of deduplicated blob used to store contents,
+	// empty if file is stored separately.
+	blob string
+	// dataKey is a wrapped key used to encrypt contents, empty if file is
+	// not encrypted.
+	dataKey string
+	// compression is an algorithm used to compress contents, empty if
+	// file is stored as is.
+	compression string
+
+	// passwordHash is a bcrypt hash of password required to download
+	// file, empty if there is none.
+	passwordHash string
+	// Brute-force protection state, see checkPassword.
+	failedAttempts int
+	lockedUntil    time.Time
+}
+
+func (fi FileInfo) MarshalJSON() ([]byte, error) {
+	res := struct {
+		UUID        string     `json:"uuid"`
+		ContentType string     `json:"content_type,omitempty"`
+		Uses        uint       `json:"uses"`
+		MaxUses     uint       `json:"max_uses,omitempty"`
+		StoreUntil  *time.Time `json:"store_until,omitempty"`
+		Size        *int64     `json:"size,omitempty"`
+		SHA256      string     `json:"sha256,omitempty"`
+		CreatedAt   *time.Time `json:"created_at,omitempty"`
+		Encryption  string     `json:"encryption,omitempty"`
+		Protected   bool       `json:"password_protected,omitempty"`
+		Sanitized   bool       `json:"sanitized,omitempty"`
+	}{
+		UUID:        fi.UUID,
+		ContentType: fi.ContentType,
+		Uses:        fi.Uses,
+		MaxUses:     fi.MaxUses,
+		SHA256:      fi.SHA256,
+		Encryption:  fi.Encryption,
+		Protected:   fi.passwordHash != "",
+		Sanitized:   fi.Sanitized,
+	}
+	if !fi.StoreUntil.IsZero() {
+		storeUntil := fi.StoreUntil.UTC()
+		res.StoreUntil = &storeUntil
+	}
+	if fi.Size >= 0 {
+		res.Size = &fi.Size
+	}
+	if !fi.CreatedAt.IsZero() {
+		createdAt := fi.CreatedAt.UTC()
+		res.CreatedAt = &createdAt
+	}
+	return json.Marshal(res)
+}
+
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	File FileInfo  `json:"file"`
+}
+
+// EventSink receives file lifecycle events.
+//
+// Publish is called synchronously from request handlers so it should
+// not block for long. If sink implements io.Closer it will be closed
+// by Server.Close.
+type EventSink interface {
+	Publish(Event)
+}
+
+// AddEventSink registers sink to receive all events published by server.
+// It should be called before server starts to handle requests.
+func (s *Server) AddEventSink(sink EventSink) {
+	s.eventSinks = append(s.eventSinks, sink)
+}
+
+func (s *Server) publish(evType EventType, info FileInfo) {
+	if len(s.eventSinks) == 0 {
+		return
+	}
+
+	s.dbgLog("Publishing event", evType, "for", info.UUID)
+	ev := Event{Type: evType, Time: time.Now().UTC(), File: info}
+	for _, sink := range s.eventSinks {
+		sink.Publish(ev)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// First file descriptor passed by systemd, see sd_listen_fds(3).
+const listenFdsStart = 3
+
+// systemdListeners returns sockets passed by systemd using socket activation
+// protocol or nil if there are none. firstFd is listenFdsStart, except for
+// tests.
+func systemdListeners(firstFd int) ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count == 0 {
+		return nil, nil
+	}
+
+	// Don't pass these to child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, count)
+	for fd := firstFd; fd < firstFd+count; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(file)
+		// FileListener dups descriptor so we don't need original anymore.
+		file.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "socket activation (fd %d)", fd)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// parseEndpoint splits endpoint in format ADDR:PORT or unix:/path into
+// network and address.
+func parseEndpoint(endpoint string) (network, address string) {
+	if strings.HasPrefix(endpoint, "unix:") {
+		return "unix", strings.TrimPrefix(endpoint, "unix:")
+	}
+	return "tcp", endpoint
+}
+
+// parseSocketPerms parses octal permissions of Unix sockets, empty string
+// means umask default and is returned as zero.
+func parseSocketPerms(perms string) (os.FileMode, error) {
+	if perms == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(perms, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if mode&^uint64(os.ModePerm) != 0 {
+		return 0, errors.New("only permission bits are allowed")
+	}
+	return os.FileMode(mode), nil
+}
+
+// listen creates listener for endpoint in format ADDR:PORT or unix:/path.
+//
+// perms is applied to created Unix sockets, zero means umask default.
+func listen(endpoint string, perms os.FileMode) (net.Listener, error) {
+	network, path := parseEndpoint(endpoint)
+	if network != "unix" {
+		return net.Listen(network, path)
+	}
+
+	// Remove stale socket left after unclean shutdown.
+	if stat, err := os.Stat(path); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if perms != 0 {
+		if err := os.Chmod(path, perms); err != nil {
+			l.Close()
+			return nil, errors.Wrap(err, "socket chmod")
+		}
+	}
+	return l, nil
+}
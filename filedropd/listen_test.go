@@ -0,0 +1,206 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	cases := []struct {
+		endpoint string
+		network  string
+		address  string
+	}{
+		{"127.0.0.1:8000", "tcp", "127.0.0.1:8000"},
+		{"[::1]:8000", "tcp", "[::1]:8000"},
+		{":8000", "tcp", ":8000"},
+		{"unix:/run/filedrop.sock", "unix", "/run/filedrop.sock"},
+		{"unix:relative.sock", "unix", "relative.sock"},
+	}
+	for _, case_ := range cases {
+		network, address := parseEndpoint(case_.endpoint)
+		if network != case_.network || address != case_.address {
+			t.Errorf("%s: got %s %s", case_.endpoint, network, address)
+		}
+	}
+}
+
+func TestParseSocketPerms(t *testing.T) {
+	cases := []struct {
+		perms string
+		mode  os.FileMode
+		fail  bool
+	}{
+		{"", 0, false},
+		{"0660", 0660, false},
+		{"600", 0600, false},
+		{"0777", 0777, false},
+		{"0980", 0, true},
+		{"rw-rw----", 0, true},
+		{"4755", 0, true},
+	}
+	for _, case_ := range cases {
+		mode, err := parseSocketPerms(case_.perms)
+		if case_.fail {
+			if err == nil {
+				t.Error("No error for", case_.perms)
+			}
+			continue
+		}
+		if err != nil {
+			t.Error("Unexpected error for", case_.perms+":", err)
+			continue
+		}
+		if mode != case_.mode {
+			t.Errorf("%s: got %o", case_.perms, mode)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filedropd-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "filedrop.sock")
+
+	// Stale socket left after unclean shutdown.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listen("unix:"+path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode()&os.ModeSocket == 0 {
+		t.Error("Not a socket:", stat.Mode())
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Errorf("Wrong socket mode: %o", stat.Mode().Perm())
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filedropd-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "filedrop.sock")
+
+	// Regular files are never removed.
+	if err := ioutil.WriteFile(path, []byte("meow"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := listen("unix:"+path, 0); err == nil {
+		l.Close()
+		t.Error("No error for regular file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error("File is removed:", err)
+	}
+}
+
+func setListenEnv(t *testing.T, pid, fds string) {
+	t.Helper()
+
+	t.Setenv("LISTEN_PID", pid)
+	t.Setenv("LISTEN_FDS", fds)
+	t.Setenv("LISTEN_FDNAMES", "http")
+}
+
+func TestSystemdListeners(t *testing.T) {
+	tcpL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpL.Close()
+	file, err := tcpL.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Passed descriptor is closed by systemdListeners.
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setListenEnv(t, strconv.Itoa(os.Getpid()), "1")
+	listeners, err := systemdListeners(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 {
+		t.Fatal("Wrong listeners count:", len(listeners))
+	}
+	defer listeners[0].Close()
+
+	if listeners[0].Addr().String() != tcpL.Addr().String() {
+		t.Error("Wrong address:", listeners[0].Addr())
+	}
+	for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(key); ok {
+			t.Error(key, "is not unset")
+		}
+	}
+
+	go func() {
+		conn, err := listeners[0].Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", tcpL.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestSystemdListenersNotPassed(t *testing.T) {
+	cases := []struct {
+		name string
+		pid  string
+		fds  string
+	}{
+		{"other process", strconv.Itoa(os.Getpid() + 1), "1"},
+		{"no pid", "", "1"},
+		{"no fds", strconv.Itoa(os.Getpid()), "0"},
+		{"invalid fds", strconv.Itoa(os.Getpid()), "meow"},
+	}
+	for _, case_ := range cases {
+		t.Run(case_.name, func(t *testing.T) {
+			setListenEnv(t, case_.pid, case_.fds)
+			listeners, err := systemdListeners(listenFdsStart)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if listeners != nil {
+				t.Error("Got listeners:", len(listeners))
+			}
+		})
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,13 +15,16 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
-func main() {
-	if len(os.Args) != 2 {
-		fmt.Println("Usage:", os.Args[0], "<config file>")
-		os.Exit(1)
-	}
+func usage() {
+	fmt.Println("Usage:")
+	fmt.Println("\t" + os.Args[0] + " <config file>")
+	fmt.Println("\t" + os.Args[0] + " migrate [status|dry-run] <config file>")
+	fmt.Println("\t" + os.Args[0] + " rotate-key <config file> <new key file>")
+	os.Exit(1)
+}
 
-	confBlob, err := ioutil.ReadFile(os.Args[1])
+func readConfig(path string) filedrop.Config {
+	confBlob, err := ioutil.ReadFile(path)
 	if err != nil {
 		log.Fatalln("Failed to read config file:", err)
 	}
@@ -28,21 +33,95 @@ func main() {
 	if err := yaml.Unmarshal(confBlob, &config); err != nil {
 		log.Fatalln("Failed to parse config file:", err)
 	}
+	return config
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	if os.Args[1] == "migrate" {
+		migrateCmd(os.Args[2:])
+		return
+	}
+	if os.Args[1] == "rotate-key" {
+		rotateKeyCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) != 2 {
+		usage()
+	}
+
+	config := readConfig(os.Args[1])
+
+	if config.TLS.Enabled() {
+		config.HTTPSDownstream = true
+	}
 
 	serv, err := filedrop.New(config)
 	if err != nil {
 		log.Fatalln("Failed to start server:", err)
 	}
 
-	go func() {
-		log.Println("Listening on", config.ListenOn+"...")
-		if err := http.ListenAndServe(config.ListenOn, serv); err != nil {
-			log.Println("Failed to listen:", err)
-			os.Exit(1)
+	perms, err := parseSocketPerms(config.SocketPerms)
+	if err != nil {
+		log.Fatalln("Invalid socket_perms:", err)
+	}
+
+	listeners, err := systemdListeners(listenFdsStart)
+	if err != nil {
+		log.Fatalln("Failed to use passed sockets:", err)
+	}
+	if listeners != nil {
+		log.Println("Using", len(listeners), "sockets passed by systemd, listen_on is ignored")
+	} else {
+		if len(config.ListenOn) == 0 {
+			log.Fatalln("No endpoints to listen on specified")
+		}
+		for _, endpoint := range config.ListenOn {
+			l, err := listen(endpoint, perms)
+			if err != nil {
+				log.Fatalln("Failed to listen:", err)
+			}
+			listeners = append(listeners, l)
 		}
-	}()
+	}
+
+	httpServ := &http.Server{
+		Handler: serv,
+	}
+	if config.TLS.Enabled() {
+		httpServ.TLSConfig, err = config.TLS.ServerConfig()
+		if err != nil {
+			log.Fatalln("Failed to configure TLS:", err)
+		}
+		if config.TLS.DisableHTTP2 {
+			// Non-nil empty map disables automatic HTTP/2 setup.
+			httpServ.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+	}
+
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			log.Println("Listening on", l.Addr().Network()+":"+l.Addr().String()+"...")
+			var err error
+			if config.TLS.Enabled() {
+				// Certificates are provided by TLSConfig.GetCertificate.
+				err = httpServ.ServeTLS(l, "", "")
+			} else {
+				err = httpServ.Serve(l)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				log.Println("Failed to serve:", err)
+				os.Exit(1)
+			}
+		}(l)
+	}
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 	<-sig
+
+	// Also removes created Unix sockets.
+	httpServ.Close()
 }
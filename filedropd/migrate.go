@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/foxcpp/filedrop"
+)
+
+func printMigration(m filedrop.MigrationInfo, verbose bool) {
+	state := "pending"
+	if m.Applied {
+		state = "applied"
+	}
+	fmt.Printf("%4d  %-8s %s\n", m.Version, state, m.Description)
+	if verbose {
+		for _, stmt := range m.Statements {
+			fmt.Println(indent(stmt))
+		}
+	}
+}
+
+func indent(stmt string) string {
+	lines := strings.Split(stmt, "\n")
+	for i, line := range lines {
+		lines[i] = "\t" + strings.TrimSpace(line)
+	}
+	return strings.Join(lines, "\n") + ";"
+}
+
+// migrateCmd implements "filedropd migrate [status|dry-run] <config file>".
+func migrateCmd(args []string) {
+	mode := "apply"
+	if len(args) == 2 {
+		mode = args[0]
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		usage()
+	}
+	config := readConfig(args[0])
+
+	switch mode {
+	case "status":
+		status, err := filedrop.SchemaStatus(config.DB)
+		if err != nil {
+			log.Fatalln("Failed to get schema status:", err)
+		}
+		for _, m := range status {
+			printMigration(m, false)
+		}
+	case "dry-run", "apply":
+		pending, err := filedrop.Migrate(config.DB, mode == "dry-run")
+		for _, m := range pending {
+			printMigration(m, mode == "dry-run")
+		}
+		if err != nil {
+			log.Fatalln("Migration failed:", err)
+		}
+		if len(pending) == 0 {
+			fmt.Println("Schema is up to date.")
+		} else if mode == "dry-run" {
+			fmt.Println(len(pending), "migrations would be applied.")
+		} else {
+			fmt.Println(len(pending), "migrations applied.")
+		}
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/foxcpp/filedrop"
+)
+
+// rotateKeyCmd implements "filedropd rotate-key <config file> <new key file>".
+func rotateKeyCmd(args []string) {
+	if len(args) != 2 {
+		usage()
+	}
+	config := readConfig(args[0])
+	if !config.Encryption.Enabled() {
+		log.Fatalln("Encryption is not configured")
+	}
+
+	newKey, err := filedrop.ReadKeyFile(args[1])
+	if err != nil {
+		log.Fatalln("Failed to read new key:", err)
+	}
+
+	rotated, err := filedrop.RotateKey(config, newKey)
+	if err != nil {
+		log.Fatalln("Key rotation failed:", err)
+	}
+	fmt.Println(rotated, "data keys re-wrapped. Update master key in configuration before starting server.")
+}
@@ -0,0 +1,104 @@
+package filedrop_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/filedrop"
+)
+
+func TestFileInfoRecorded(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	defer cleanServ(serv)
+
+	before := time.Now().Add(-time.Second)
+	fileUUID, err := serv.AddFile(strings.NewReader(file), "text/plain", 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := serv.FileInfo(fileUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte(file))
+	if info.Size != int64(len(file)) {
+		t.Error("Wrong size:", info.Size)
+	}
+	if info.SHA256 != hex.EncodeToString(hash[:]) {
+		t.Error("Wrong hash:", info.SHA256)
+	}
+	if info.CreatedAt.Before(before) || info.CreatedAt.After(time.Now()) {
+		t.Error("Wrong creation time:", info.CreatedAt)
+	}
+	if info.Uses != 0 {
+		t.Error("FileInfo counted as use")
+	}
+
+	if _, err := serv.FileInfo("AAAAAAAA-AAAA-AAAA-AAAA-AAAAAAAAAAAA"); err != filedrop.ErrFileDoesntExists {
+		t.Error("Wrong error for non-existent file:", err)
+	}
+}
+
+func TestDigestHeaders(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	hash := sha256.Sum256([]byte(file))
+	if resp.Header.Get("ETag") != `"`+hex.EncodeToString(hash[:])+`"` {
+		t.Error("Wrong ETag:", resp.Header.Get("ETag"))
+	}
+	if resp.Header.Get("Repr-Digest") != "sha-256=:"+base64.StdEncoding.EncodeToString(hash[:])+":" {
+		t.Error("Wrong Repr-Digest:", resp.Header.Get("Repr-Digest"))
+	}
+	if resp.ContentLength != int64(len(file)) {
+		t.Error("Wrong Content-Length:", resp.ContentLength)
+	}
+}
+
+func TestSizeMismatch(t *testing.T) {
+	conf := filedrop.Default
+	conf.Limits.MaxUses = 1
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	splittenURL := strings.Split(url, "/")
+	fileUUID := splittenURL[len(splittenURL)-1]
+
+	if err := os.Truncate(filepath.Join(serv.Conf.StorageDir, fileUUID), 10); err != nil {
+		t.Fatal(err)
+	}
+	if code := doGETFail(t, c, url); code != 500 {
+		t.Error("GET: HTTP", code)
+	}
+
+	info, err := serv.FileInfo(fileUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Uses != 0 {
+		t.Error("Failed download counted as use")
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+
+package filedrop
+
+func freeSpace(dir string) (uint64, error) {
+	return 0, errFreeSpaceUnsupported
+}
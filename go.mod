@@ -1,11 +1,25 @@
 module github.com/foxcpp/filedrop
 
+go 1.23.0
+
 require (
+	github.com/alecthomas/chroma/v2 v2.14.0
 	github.com/go-sql-driver/mysql v1.4.0
 	github.com/gofrs/uuid v3.2.0+incompatible
+	github.com/klauspost/compress v1.17.11
 	github.com/lib/pq v1.0.0
 	github.com/mattn/go-sqlite3 v1.9.0
 	github.com/pkg/errors v0.8.0
-	google.golang.org/appengine v1.2.0 // indirect
+	golang.org/x/crypto v0.31.0
+	golang.org/x/image v0.25.0
 	gopkg.in/yaml.v2 v2.2.1
 )
+
+require (
+	github.com/dlclark/regexp2 v1.11.0 // indirect
+	github.com/golang/protobuf v1.2.0 // indirect
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
+	google.golang.org/appengine v1.2.0 // indirect
+	gopkg.in/check.v1 v0.0.0-20161208181325-20d25e280405 // indirect
+)
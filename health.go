@@ -0,0 +1,118 @@
+package filedrop
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errFreeSpaceUnsupported = errors.New("free space check is not supported")
+
+// CheckResult is a result of a single health check.
+type CheckResult struct {
+	OK      bool        `json:"ok"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// HealthStatus is a result of liveness or readiness check.
+// OK is true only if all checks passed.
+type HealthStatus struct {
+	OK     bool                   `json:"ok"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+func (hs *HealthStatus) add(name string, res CheckResult) {
+	hs.Checks[name] = res
+	if !res.OK {
+		hs.OK = false
+	}
+}
+
+// Liveness checks whether server is functioning. Currently it only checks
+// that files clean-up goroutine is not stuck.
+func (s *Server) Liveness() HealthStatus {
+	status := HealthStatus{OK: true, Checks: map[string]CheckResult{}}
+	status.add("cleaner", s.checkCleaner())
+	return status
+}
+
+// Readiness checks whether server is ready to serve requests: database is
+// reachable, storage is writable and has enough free space.
+func (s *Server) Readiness() HealthStatus {
+	status := HealthStatus{OK: true, Checks: map[string]CheckResult{}}
+	status.add("db", s.checkDB())
+	status.add("storage", s.checkStorage())
+	status.add("disk_space", s.checkDiskSpace())
+	status.add("cleaner", s.checkCleaner())
+	return status
+}
+
+func (s *Server) checkDB() CheckResult {
+	if err := s.DB.Ping(); err != nil {
+		return CheckResult{Error: "ping: " + err.Error()}
+	}
+	if err := s.DB.Probe(); err != nil {
+		return CheckResult{Error: "query: " + err.Error()}
+	}
+	return CheckResult{OK: true}
+}
+
+func (s *Server) checkStorage() CheckResult {
+	if err := s.testPerms(); err != nil {
+		return CheckResult{Error: err.Error()}
+	}
+	return CheckResult{OK: true}
+}
+
+func (s *Server) checkDiskSpace() CheckResult {
+	free, err := freeSpace(s.Conf.StorageDir)
+	if err != nil {
+		// Not supported on this platform or filesystem, can't judge.
+		if err == errFreeSpaceUnsupported {
+			return CheckResult{OK: true}
+		}
+		return CheckResult{Error: err.Error()}
+	}
+
+	details := map[string]uint64{
+		"free_bytes": free,
+		"min_bytes":  s.Conf.Health.MinFreeBytes,
+	}
+	if free < s.Conf.Health.MinFreeBytes {
+		return CheckResult{Error: "not enough free space", Details: details}
+	}
+	return CheckResult{OK: true, Details: details}
+}
+
+func (s *Server) checkCleaner() CheckResult {
+	lastRun := s.cleanerHeartbeat.Load().(time.Time)
+	details := map[string]interface{}{
+		"last_run": lastRun.UTC().Format(time.RFC3339),
+	}
+
+	// Give cleaner some time to finish long clean-up.
+	maxDelay := 3*time.Duration(s.Conf.CleanupIntervalSecs)*time.Second + 10*time.Second
+	if time.Since(lastRun) > maxDelay {
+		return CheckResult{Error: "clean-up goroutine is stuck", Details: details}
+	}
+	return CheckResult{OK: true, Details: details}
+}
+
+func (s *Server) serveHealth(w http.ResponseWriter, r *http.Request, status HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status.OK {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		s.Logger.Printf("I/O error (URL %v, IP %v): %v", r.URL.String(), r.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,101 @@
+package filedrop_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/foxcpp/filedrop"
+)
+
+func getHealth(t *testing.T, c *http.Client, url string) (int, filedrop.HealthStatus) {
+	t.Helper()
+
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Error("GET:", err)
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Error("Wrong content type:", resp.Header.Get("Content-Type"))
+	}
+	status := filedrop.HealthStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Error("JSON decode:", err)
+		t.FailNow()
+	}
+	return resp.StatusCode, status
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	conf := filedrop.Default
+	conf.Health.LivenessPath = "/healthz"
+	conf.Health.ReadinessPath = "/readyz"
+	conf.DownloadAuth.Callback = func(*http.Request) bool { return false }
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	t.Run("liveness", func(t *testing.T) {
+		code, status := getHealth(t, c, ts.URL+"/healthz")
+		if code != 200 || !status.OK || !status.Checks["cleaner"].OK {
+			t.Errorf("HTTP %d, %+v", code, status)
+		}
+	})
+	t.Run("readiness", func(t *testing.T) {
+		code, status := getHealth(t, c, ts.URL+"/readyz")
+		if code != 200 || !status.OK {
+			t.Errorf("HTTP %d, %+v", code, status)
+		}
+		for _, check := range []string{"db", "storage", "disk_space", "cleaner"} {
+			if _, ok := status.Checks[check]; !ok {
+				t.Error("Missing check:", check)
+			}
+		}
+	})
+	t.Run("other paths still require auth", func(t *testing.T) {
+		if code := doGETFail(t, c, ts.URL+"/healthz/foo"); code != 403 {
+			t.Error("GET: HTTP", code)
+		}
+	})
+}
+
+func TestReadinessNoSpace(t *testing.T) {
+	conf := filedrop.Default
+	conf.Health.ReadinessPath = "/readyz"
+	conf.Health.MinFreeBytes = 1 << 62
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	code, status := getHealth(t, c, ts.URL+"/readyz")
+	if code != 503 || status.OK || status.Checks["disk_space"].OK {
+		t.Errorf("HTTP %d, %+v", code, status)
+	}
+}
+
+func TestReadinessDBDown(t *testing.T) {
+	conf := filedrop.Default
+	conf.Health.ReadinessPath = "/readyz"
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	if _, err := serv.DB.Exec(`ALTER TABLE filedrop RENAME TO filedrop_moved`); err != nil {
+		t.Fatal(err)
+	}
+	defer serv.DB.Exec(`ALTER TABLE filedrop_moved RENAME TO filedrop`)
+
+	code, status := getHealth(t, c, ts.URL+"/readyz")
+	if code != 503 || status.OK || status.Checks["db"].OK {
+		t.Errorf("HTTP %d, %+v", code, status)
+	}
+}
@@ -0,0 +1,108 @@
+package filedrop
+
+import (
+	"net/http"
+	"time"
+)
+
+// UploadParams are file parameters that can be changed by BeforeUploadHook.
+type UploadParams struct {
+	ContentType string
+	// MaxUses is zero if there is no limit.
+	MaxUses uint
+	// StoreUntil is zero if there is no limit.
+	StoreUntil time.Time
+	// StripMetadata requests removal of metadata from JPEG and PNG images.
+	StripMetadata bool
+}
+
+// BeforeUploadHook is called before file is stored. It can change params
+// (limits are not checked again) or reject upload by returning error.
+type BeforeUploadHook interface {
+	BeforeUpload(r *http.Request, params *UploadParams) error
+}
+
+// AfterUploadHook is called after file is stored.
+type AfterUploadHook interface {
+	AfterUpload(r *http.Request, info FileInfo)
+}
+
+// BeforeDownloadHook is called before file is served and access is counted
+// as a "use". It can reject download by returning error.
+type BeforeDownloadHook interface {
+	BeforeDownload(r *http.Request, info FileInfo) error
+}
+
+// AfterDownloadHook is called after file is served.
+type AfterDownloadHook interface {
+	AfterDownload(r *http.Request, info FileInfo)
+}
+
+// RemoveHook is called after file is removed for any reason.
+type RemoveHook interface {
+	OnRemove(info FileInfo)
+}
+
+// RejectError can be returned by hooks to reject request with specific
+// HTTP status code and message. Other errors result in 403 Forbidden.
+type RejectError struct {
+	Code   int
+	Reason string
+}
+
+func (e RejectError) Error() string {
+	return e.Reason
+}
+
+type hooks struct {
+	beforeUpload   []BeforeUploadHook
+	afterUpload    []AfterUploadHook
+	beforeDownload []BeforeDownloadHook
+	afterDownload  []AfterDownloadHook
+	onRemove       []RemoveHook
+}
+
+// AddHook registers hook which should implement one or more of
+// BeforeUploadHook, AfterUploadHook, BeforeDownloadHook, AfterDownloadHook
+// and RemoveHook interfaces. Hooks are called in order of registration.
+//
+// It should be called before server starts to handle requests.
+// AddHook panics if hook doesn't implements any of hook interfaces.
+func (s *Server) AddHook(hook interface{}) {
+	known := false
+	if h, ok := hook.(BeforeUploadHook); ok {
+		s.hooks.beforeUpload = append(s.hooks.beforeUpload, h)
+		known = true
+	}
+	if h, ok := hook.(AfterUploadHook); ok {
+		s.hooks.afterUpload = append(s.hooks.afterUpload, h)
+		known = true
+	}
+	if h, ok := hook.(BeforeDownloadHook); ok {
+		s.hooks.beforeDownload = append(s.hooks.beforeDownload, h)
+		known = true
+	}
+	if h, ok := hook.(AfterDownloadHook); ok {
+		s.hooks.afterDownload = append(s.hooks.afterDownload, h)
+		known = true
+	}
+	if h, ok := hook.(RemoveHook); ok {
+		s.hooks.onRemove = append(s.hooks.onRemove, h)
+		known = true
+	}
+	if !known {
+		panic("filedrop: AddHook called with object that doesn't implement any hook interface")
+	}
+}
+
+func (s *Server) writeRejection(w http.ResponseWriter, r *http.Request, err error) {
+	if rejErr, ok := err.(RejectError); ok {
+		s.writeErr(w, r, rejErr.Code, rejErr.Reason)
+		return
+	}
+	if rejErr, ok := err.(*RejectError); ok {
+		s.writeErr(w, r, rejErr.Code, rejErr.Reason)
+		return
+	}
+	s.writeErr(w, r, http.StatusForbidden, "forbidden")
+}
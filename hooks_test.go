@@ -0,0 +1,159 @@
+package filedrop_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/filedrop"
+)
+
+type testHook struct {
+	lock  sync.Mutex
+	calls []string
+
+	uploaded filedrop.FileInfo
+}
+
+func (h *testHook) record(call string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.calls = append(h.calls, call)
+}
+
+func (h *testHook) BeforeUpload(r *http.Request, params *filedrop.UploadParams) error {
+	h.record("BeforeUpload")
+	if r.URL.Query().Get("reject") == "1" {
+		return filedrop.RejectError{Code: http.StatusPaymentRequired, Reason: "pay first"}
+	}
+	if r.URL.Query().Get("reject") == "2" {
+		return errors.New("nope")
+	}
+	params.ContentType = "text/x-rewritten"
+	params.MaxUses = 1
+	return nil
+}
+
+func (h *testHook) AfterUpload(r *http.Request, info filedrop.FileInfo) {
+	h.record("AfterUpload")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.uploaded = info
+}
+
+func (h *testHook) BeforeDownload(r *http.Request, info filedrop.FileInfo) error {
+	h.record("BeforeDownload")
+	if r.URL.Query().Get("reject") == "1" {
+		return errors.New("nope")
+	}
+	return nil
+}
+
+func (h *testHook) AfterDownload(r *http.Request, info filedrop.FileInfo) {
+	h.record("AfterDownload")
+}
+
+func (h *testHook) OnRemove(info filedrop.FileInfo) {
+	h.record("OnRemove")
+}
+
+func (h *testHook) Calls() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return strings.Join(h.calls, ",")
+}
+
+func TestHooks(t *testing.T) {
+	hook := &testHook{}
+	serv := initServ(filedrop.Default)
+	serv.AddHook(hook)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	t.Run("upload rejected with code", func(t *testing.T) {
+		if code := doPOSTFail(t, c, ts.URL+"/filedrop?reject=1", "text/plain", strings.NewReader(file)); code != http.StatusPaymentRequired {
+			t.Error("POST: HTTP", code)
+		}
+	})
+	t.Run("upload rejected", func(t *testing.T) {
+		if code := doPOSTFail(t, c, ts.URL+"/filedrop?reject=2", "text/plain", strings.NewReader(file)); code != http.StatusForbidden {
+			t.Error("POST: HTTP", code)
+		}
+	})
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+
+	t.Run("upload info", func(t *testing.T) {
+		hook.lock.Lock()
+		info := hook.uploaded
+		hook.lock.Unlock()
+
+		stored, err := serv.FileInfo(info.UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(url, "/"+info.UUID) {
+			t.Error("Wrong UUID:", info.UUID)
+		}
+		if info.Size != int64(len(file)) || info.SHA256 != stored.SHA256 || len(info.SHA256) != 64 {
+			t.Error("Wrong size or checksum:", info.Size, info.SHA256)
+		}
+		if info.CreatedAt.IsZero() || !info.CreatedAt.Equal(stored.CreatedAt) {
+			t.Error("Wrong creation time:", info.CreatedAt, stored.CreatedAt)
+		}
+		if info.ContentType != "text/x-rewritten" || info.MaxUses != 1 {
+			t.Error("Wrong params:", info.ContentType, info.MaxUses)
+		}
+	})
+	t.Run("download rejected", func(t *testing.T) {
+		if code := doGETFail(t, c, url+"?reject=1"); code != http.StatusForbidden {
+			t.Error("GET: HTTP", code)
+		}
+	})
+	t.Run("params rewritten", func(t *testing.T) {
+		resp, err := c.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("Content-Type") != "text/x-rewritten" {
+			t.Error("Content type not rewritten:", resp.Header.Get("Content-Type"))
+		}
+		// Rejected download should not count as use, so max-uses=1 is
+		// exhausted only now.
+		doGETFail(t, c, url)
+	})
+
+	// Give time for AfterDownload called after response is sent.
+	time.Sleep(100 * time.Millisecond)
+
+	expected := "BeforeUpload,BeforeUpload,BeforeUpload,AfterUpload," +
+		"BeforeDownload,BeforeDownload,AfterDownload,BeforeDownload,OnRemove"
+	if calls := hook.Calls(); calls != expected {
+		t.Errorf("Wrong hook calls:\n\tWanted: %v\n\tGot:    %v", expected, calls)
+	}
+}
+
+func TestRemoveHook(t *testing.T) {
+	hook := &testHook{}
+	serv := initServ(filedrop.Default)
+	serv.AddHook(hook)
+	defer cleanServ(serv)
+
+	fileUUID, err := serv.AddFile(strings.NewReader(file), "text/plain", 0, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := serv.RemoveFile(fileUUID); err != nil {
+		t.Fatal(err)
+	}
+	if calls := hook.Calls(); calls != "OnRemove" {
+		t.Error("Wrong hook calls:", calls)
+	}
+}
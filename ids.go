@@ -0,0 +1,320 @@
+package filedrop
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	IDGeneratorUUID   = "uuid"
+	IDGeneratorBase62 = "base62"
+	IDGeneratorWords  = "words"
+)
+
+// maxIDLen is a maximum length of file ID, it is limited by DB column.
+const maxIDLen = 36
+
+// minSlugLen is a minimum length of uploader-chosen file ID.
+const minSlugLen = 3
+
+// idRetries is how much times addFile tries to generate unused ID.
+const idRetries = 5
+
+// ErrIDTaken is returned if requested file ID is already used.
+var ErrIDTaken = errors.New("file ID is already taken")
+
+// IDGenerator generates IDs of uploaded files. Returned IDs should be
+// unique with high probability, addFile retries on collision. IDs must
+// be 1 to 36 characters long and consist of ASCII letters, digits, "-"
+// and "_".
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+// UUIDGenerator generates random (version 4) UUIDs.
+type UUIDGenerator struct{}
+
+func (UUIDGenerator) NewID() (string, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+const base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Base62Generator generates random IDs of Length letters and digits.
+// Each character has ~5.95 bits of entropy.
+type Base62Generator struct {
+	Length int
+}
+
+func (g Base62Generator) NewID() (string, error) {
+	return randomString(g.Length, len(base62Alphabet), func(i int) string {
+		return base62Alphabet[i : i+1]
+	}, "")
+}
+
+// WordsGenerator generates IDs of Count random words separated by "-",
+// like "lake-oven-ruby-moth". Each word has 8 bits of entropy.
+type WordsGenerator struct {
+	Count int
+}
+
+func (g WordsGenerator) NewID() (string, error) {
+	return randomString(g.Count, len(idWords), func(i int) string {
+		return idWords[i]
+	}, "-")
+}
+
+// randomString joins n elements picked uniformly using crypto/rand.
+func randomString(n, max int, element func(int) string, sep string) (string, error) {
+	if n <= 0 {
+		return "", errors.New("invalid ID length")
+	}
+	parts := make([]string, n)
+	bigMax := big.NewInt(int64(max))
+	for i := range parts {
+		index, err := rand.Int(rand.Reader, bigMax)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = element(int(index.Int64()))
+	}
+	return strings.Join(parts, sep), nil
+}
+
+// newIDGenerator creates generator configured by conf.
+func newIDGenerator(conf IDsConfig) (IDGenerator, error) {
+	switch conf.Generator {
+	case "", IDGeneratorUUID:
+		return UUIDGenerator{}, nil
+	case IDGeneratorBase62:
+		length := conf.Length
+		if length == 0 {
+			length = 8
+		}
+		if length < 4 || length > maxIDLen {
+			return nil, errors.New("ids: length must be between 4 and 36 for base62 generator")
+		}
+		return Base62Generator{Length: length}, nil
+	case IDGeneratorWords:
+		count := conf.Length
+		if count == 0 {
+			count = 4
+		}
+		if count < 2 || count > 7 {
+			return nil, errors.New("ids: length must be between 2 and 7 for words generator")
+		}
+		return WordsGenerator{Count: count}, nil
+	default:
+		return nil, errors.New("ids: unknown generator: " + conf.Generator)
+	}
+}
+
+// SetIDGenerator replaces generator of file IDs configured by
+// Conf.IDs. Existing files are not affected.
+//
+// It should be called before server starts to handle requests.
+func (s *Server) SetIDGenerator(gen IDGenerator) {
+	s.idGen = gen
+}
+
+// validFileID checks whether id can be file ID. UUIDs of files
+// uploaded before IDs became configurable are valid too.
+func validFileID(id string) bool {
+	if id == "" || len(id) > maxIDLen {
+		return false
+	}
+	for _, ch := range id {
+		if !(ch >= 'a' && ch <= 'z') && !(ch >= 'A' && ch <= 'Z') && !(ch >= '0' && ch <= '9') && ch != '-' && ch != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// reservedSlugs are never used as uploader-chosen file IDs.
+var reservedSlugs = []string{"filedrop"}
+
+// validSlug checks whether slug can be used as uploader-chosen file ID.
+// Slugs equal to one of reserved names are rejected, so they don't shadow
+// paths served by Server. UUIDs are rejected too, so links with UUIDs
+// are never resolved as slugs.
+func validSlug(slug string, reserved []string) bool {
+	if len(slug) < minSlugLen || !validFileID(slug) || isUUID(slug) {
+		return false
+	}
+	for _, name := range reserved {
+		// Comparison of IDs may be case-insensitive in DB.
+		if strings.EqualFold(slug, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// reservedNames returns names which can't be used as slugs. These are
+// components of paths served by Server, links to files with slugs are
+// placed next to them.
+func (s *Server) reservedNames() []string {
+	reserved := append([]string{}, reservedSlugs...)
+	for _, p := range []string{s.Conf.E2EPagePath, s.Conf.Health.LivenessPath, s.Conf.Health.ReadinessPath} {
+		for _, name := range strings.Split(p, "/") {
+			if name != "" {
+				reserved = append(reserved, name)
+			}
+		}
+	}
+	return reserved
+}
+
+// idTaken checks whether file ID is used by stored file.
+func (s *Server) idTaken(id string) (bool, error) {
+	err := retryQuery(func() error {
+		_, err := s.DB.FileInfo(nil, id)
+		return err
+	})
+	if err != sql.ErrNoRows {
+		if err != nil {
+			return false, errors.Wrap(err, "db query")
+		}
+		return true, nil
+	}
+	if _, err := os.Stat(filepath.Join(s.Conf.StorageDir, id)); !os.IsNotExist(err) {
+		return true, err
+	}
+	return false, nil
+}
+
+// newFileID generates unused file ID.
+func (s *Server) newFileID() (string, error) {
+	for i := 0; i < idRetries; i++ {
+		id, err := s.idGen.NewID()
+		if err != nil {
+			return "", errors.Wrap(err, "ID generation")
+		}
+		if !validFileID(id) {
+			return "", errors.New("ID generation: invalid ID: " + id)
+		}
+		taken, err := s.idTaken(id)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return id, nil
+		}
+		s.Logger.Println("ID collision detected:", id)
+	}
+	return "", errors.New("ID generation: too many collisions")
+}
+
+func isUUID(id string) bool {
+	_, err := uuid.FromString(id)
+	return err == nil
+}
+
+// hasUUIDComponent checks whether one of last two components of URL path
+// is UUID, so it is a link to file.
+func hasUUIDComponent(urlPath string) bool {
+	splittenPath := strings.Split(urlPath, "/")
+	if len(splittenPath) >= 2 && isUUID(splittenPath[len(splittenPath)-2]) {
+		return true
+	}
+	return isUUID(splittenPath[len(splittenPath)-1])
+}
+
+// resolveFilePath extracts file ID and fake "filename" (may be empty)
+// from download URL path. ID is looked up in DB, so paths of
+// non-existent files are not resolved.
+//
+// If slugs are enabled, links are "<link base>/<ID>[/<name>]" (see
+// linkBase) and ID is taken only from that position, so uploader-chosen
+// IDs can't take over links of other files. Otherwise, second to last
+// path component is the ID if the last one is a file name, last
+// component is used as ID only if there is no file with such ID, that is
+// for links without file name. UUIDs in last component are never file
+// names, so links to files uploaded before IDs became configurable are
+// resolved as before.
+func (s *Server) resolveFilePath(urlPath string) (info FileInfo, fileName string, err error) {
+	if s.Conf.IDs.Slugs && !hasUUIDComponent(urlPath) {
+		base := "/"
+		if s.downloadURL != nil {
+			base = s.downloadURL.Path + "/"
+		}
+		if !strings.HasPrefix(urlPath, base) {
+			return FileInfo{}, "", ErrFileDoesntExists
+		}
+		splittenPath := strings.Split(strings.TrimPrefix(urlPath, base), "/")
+		if len(splittenPath) > 2 || !validFileID(splittenPath[0]) {
+			return FileInfo{}, "", ErrFileDoesntExists
+		}
+		if len(splittenPath) == 2 {
+			fileName = splittenPath[1]
+		}
+		info, err = s.FileInfo(splittenPath[0])
+		return info, fileName, err
+	}
+
+	splittenPath := strings.Split(urlPath, "/")
+	last := splittenPath[len(splittenPath)-1]
+	if len(splittenPath) >= 2 && !isUUID(last) {
+		id := splittenPath[len(splittenPath)-2]
+		if validFileID(id) {
+			info, err := s.FileInfo(id)
+			if err != ErrFileDoesntExists {
+				return info, last, err
+			}
+		}
+	}
+	if !validFileID(last) {
+		return FileInfo{}, "", ErrFileDoesntExists
+	}
+	info, err = s.FileInfo(last)
+	return info, "", err
+}
+
+// idWords is a list of words used by WordsGenerator. Words are at most 4
+// letters long, so IDs of 7 words fit into maxIDLen.
+var idWords = [256]string{
+	"able", "acid", "aged", "also", "area", "army", "away", "baby",
+	"back", "ball", "band", "bank", "base", "bath", "bear", "beat",
+	"bell", "belt", "bird", "blue", "boat", "body", "bone", "book",
+	"boot", "born", "boss", "both", "bowl", "bulk", "burn", "bush",
+	"busy", "cake", "calm", "camp", "card", "care", "cart", "case",
+	"cash", "cast", "cell", "chat", "chef", "chip", "city", "clay",
+	"clip", "club", "coal", "coat", "code", "cold", "cook", "cool",
+	"cope", "copy", "core", "corn", "cost", "crew", "crop", "cube",
+	"cure", "dark", "data", "dawn", "deal", "dear", "deep", "deer",
+	"desk", "dial", "diet", "disk", "dock", "door", "dose", "dove",
+	"down", "draw", "drum", "duck", "dune", "dust", "duty", "each",
+	"earn", "east", "easy", "edge", "else", "epic", "even", "exit",
+	"face", "fact", "fair", "fall", "farm", "fast", "fern", "file",
+	"film", "find", "fine", "fire", "firm", "fish", "flag", "flat",
+	"flow", "foam", "fold", "folk", "fond", "food", "foot", "fork",
+	"form", "fort", "free", "frog", "fuel", "full", "fund", "gain",
+	"game", "gate", "gear", "gift", "girl", "glad", "glow", "goal",
+	"gold", "golf", "good", "gown", "grab", "gray", "grid", "grow",
+	"gulf", "hair", "half", "hall", "hand", "hard", "harp", "hawk",
+	"head", "heat", "herb", "hero", "high", "hill", "hint", "hive",
+	"hold", "holy", "home", "hood", "hook", "hope", "horn", "host",
+	"hour", "huge", "hunt", "idea", "inch", "iron", "isle", "jade",
+	"jazz", "jump", "jury", "keen", "keep", "kind", "king", "kite",
+	"knot", "lady", "lake", "lamb", "lamp", "land", "lane", "last",
+	"lava", "lawn", "lead", "leaf", "lens", "life", "lift", "lily",
+	"lime", "line", "link", "lion", "list", "live", "load", "loaf",
+	"lock", "loft", "long", "loop", "lord", "loud", "love", "luck",
+	"lush", "main", "make", "mall", "many", "mask", "meal", "meat",
+	"melt", "mild", "milk", "mill", "mind", "mint", "mist", "mode",
+	"mole", "mood", "moon", "moss", "most", "moth", "move", "much",
+	"mule", "nest", "news", "next", "nice", "note", "oak", "oath", "odd",
+	"open", "oval", "oven", "pace", "pack", "page", "palm",
+}
@@ -0,0 +1,244 @@
+package filedrop_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/filedrop"
+)
+
+// sequenceGenerator returns IDs from list in order.
+type sequenceGenerator struct {
+	ids []string
+}
+
+func (g *sequenceGenerator) NewID() (string, error) {
+	id := g.ids[0]
+	g.ids = g.ids[1:]
+	return id, nil
+}
+
+func lastComponent(url string) string {
+	return url[strings.LastIndex(url, "/")+1:]
+}
+
+func TestIDGenerators(t *testing.T) {
+	cases := []struct {
+		generator string
+		length    int
+		re        string
+	}{
+		{filedrop.IDGeneratorUUID, 0, "^[0-9a-f-]{36}$"},
+		{filedrop.IDGeneratorBase62, 0, "^[0-9A-Za-z]{8}$"},
+		{filedrop.IDGeneratorBase62, 12, "^[0-9A-Za-z]{12}$"},
+		{filedrop.IDGeneratorWords, 0, "^[a-z]+(-[a-z]+){3}$"},
+		{filedrop.IDGeneratorWords, 2, "^[a-z]+-[a-z]+$"},
+	}
+	for _, case_ := range cases {
+		t.Run(case_.generator, func(t *testing.T) {
+			conf := filedrop.Default
+			conf.IDs.Generator = case_.generator
+			conf.IDs.Length = case_.length
+			serv := initServ(conf)
+			ts := httptest.NewServer(serv)
+			defer cleanServ(serv)
+			defer ts.Close()
+			c := ts.Client()
+
+			url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+			if !regexp.MustCompile(case_.re).MatchString(lastComponent(url)) {
+				t.Error("Wrong ID:", url)
+			}
+			if body := doGET(t, c, url); string(body) != file {
+				t.Error("Got different file!")
+			}
+			if body := doGET(t, c, url+"/meow.txt"); string(body) != file {
+				t.Error("Got different file with file name!")
+			}
+		})
+	}
+}
+
+func TestIDCollision(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	serv.SetIDGenerator(&sequenceGenerator{ids: []string{"meow", "meow", "purr"}})
+
+	first := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	second := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	if lastComponent(first) != "meow" || lastComponent(second) != "purr" {
+		t.Error("Wrong IDs:", first, second)
+	}
+}
+
+func TestUUIDLinksAfterGeneratorChange(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	uuidURL := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	serv.SetIDGenerator(filedrop.Base62Generator{Length: 6})
+	shortURL := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	if len(lastComponent(shortURL)) != 6 {
+		t.Error("Wrong ID:", shortURL)
+	}
+
+	for _, url := range []string{uuidURL, uuidURL + "/meow.txt", shortURL, shortURL + "/meow.txt"} {
+		if body := doGET(t, c, url); string(body) != file {
+			t.Error("Got different file for", url)
+		}
+	}
+}
+
+func TestSlugs(t *testing.T) {
+	conf := filedrop.Default
+	conf.IDs.Slugs = true
+	conf.Health.LivenessPath = "/healthz"
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop?slug=my_cat-pics", "text/plain", strings.NewReader(file)))
+	if url != ts.URL+"/my_cat-pics" {
+		t.Fatal("Wrong URL:", url)
+	}
+	if body := doGET(t, c, url+"/cat.txt"); string(body) != file {
+		t.Error("Got different file!")
+	}
+
+	t.Run("taken", func(t *testing.T) {
+		code := doPOSTFail(t, c, ts.URL+"/filedrop?slug=my_cat-pics", "text/plain", strings.NewReader(file))
+		if code != http.StatusConflict {
+			t.Error("POST: HTTP", code)
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		for _, slug := range []string{"ab", "cat.txt", "cat%2Fpics", strings.Repeat("a", 37)} {
+			code := doPOSTFail(t, c, ts.URL+"/filedrop?slug="+slug, "text/plain", strings.NewReader(file))
+			if code != http.StatusBadRequest {
+				t.Error("POST", slug+": HTTP", code)
+			}
+		}
+	})
+	t.Run("reserved", func(t *testing.T) {
+		for _, path := range []string{"/filedrop?slug=filedrop", "/filedrop?slug=FileDrop", "/filedrop?slug=healthz",
+			"/filedrop?slug=41a8f78c-ce06-11e8-b2ed-b083fe9824ac", "/filedrop?slug=41a8f78cce0611e8b2edb083fe9824ac"} {
+			code := doPOSTFail(t, c, ts.URL+path, "text/plain", strings.NewReader(file))
+			if code != http.StatusBadRequest {
+				t.Error("POST", path+": HTTP", code)
+			}
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		serv.Conf.IDs.Slugs = false
+		defer func() { serv.Conf.IDs.Slugs = true }()
+
+		code := doPOSTFail(t, c, ts.URL+"/filedrop?slug=dog-pics", "text/plain", strings.NewReader(file))
+		if code != http.StatusBadRequest {
+			t.Error("POST: HTTP", code)
+		}
+	})
+}
+
+func TestSlugEqualToFileName(t *testing.T) {
+	conf := filedrop.Default
+	conf.IDs.Generator = filedrop.IDGeneratorBase62
+	conf.IDs.Slugs = true
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	victim := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	slugURL := string(doPOST(t, c, ts.URL+"/filedrop?slug=README", "text/plain", strings.NewReader("meow")))
+	if slugURL != ts.URL+"/README" {
+		t.Fatal("Wrong URL:", slugURL)
+	}
+
+	if body := doGET(t, c, victim+"/README"); string(body) != file {
+		t.Error("Link with file name is taken over by slug:", string(body))
+	}
+	if body := doGET(t, c, victim); string(body) != file {
+		t.Error("Got different file!")
+	}
+	if body := doGET(t, c, slugURL); string(body) != "meow" {
+		t.Error("Got different file for slug:", string(body))
+	}
+	if body := doGET(t, c, slugURL+"/cat.txt"); string(body) != "meow" {
+		t.Error("Got different file for slug with file name:", string(body))
+	}
+}
+
+func TestSlugUploadPath(t *testing.T) {
+	// Slug equal to upload path of other file must not take over its link.
+	cases := []struct {
+		name        string
+		downloadURL string
+		host        string
+	}{
+		{"same host", "", ""},
+		{"download_url", "https://files.example.org/d/", "files.example.org"},
+	}
+	for _, case_ := range cases {
+		t.Run(case_.name, func(t *testing.T) {
+			conf := filedrop.Default
+			conf.IDs.Generator = filedrop.IDGeneratorBase62
+			conf.IDs.Slugs = true
+			conf.DownloadURL = case_.downloadURL
+			serv := initServ(conf)
+			ts := httptest.NewServer(serv)
+			defer cleanServ(serv)
+			defer ts.Close()
+			c := ts.Client()
+
+			victim, err := url.Parse(string(doPOST(t, c, ts.URL+"/share", "text/plain", strings.NewReader(file))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, slug := range []string{"share", "d"} {
+				resp, err := c.Post(ts.URL+"/?slug="+slug, "text/plain", strings.NewReader("evil"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusBadRequest {
+					t.Fatal("POST", slug+": HTTP", resp.StatusCode)
+				}
+			}
+
+			resp, body := doWithHost(t, c, http.MethodGet, ts.URL+victim.Path, case_.host, nil)
+			if resp.StatusCode != http.StatusOK || string(body) != file {
+				t.Error("Link is taken over by slug:", resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestIDsConfigInvalid(t *testing.T) {
+	cases := []filedrop.IDsConfig{
+		{Generator: "meow"},
+		{Generator: filedrop.IDGeneratorBase62, Length: 2},
+		{Generator: filedrop.IDGeneratorBase62, Length: 40},
+		{Generator: filedrop.IDGeneratorWords, Length: 10},
+	}
+	for _, ids := range cases {
+		conf := filedrop.Default
+		conf.IDs = ids
+		if _, err := filedrop.New(conf); err == nil {
+			t.Error("No error for", ids)
+		}
+	}
+}
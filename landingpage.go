@@ -0,0 +1,76 @@
+package filedrop
+
+import (
+	"net/http"
+	"time"
+)
+
+const downloadPageTemplate = "download.html"
+
+// downloadPageData is passed to landing page template.
+type downloadPageData struct {
+	// Name is a file name from URL, empty if not specified.
+	Name        string
+	ContentType string
+
+	// Size is a file size in bytes, -1 if unknown.
+	Size     int64
+	SizeText string
+
+	// UsesLeft is a number of remaining downloads, -1 if unlimited.
+	UsesLeft int
+
+	// Expires is a time when file will be removed, zero if never.
+	Expires     time.Time
+	ExpiresText string
+
+	// DownloadURL is a relative URL of file contents.
+	DownloadURL string
+
+	// AssetsPath is a relative URL of static assets directory.
+	AssetsPath string
+}
+
+// formatRemaining formats time left until file expiration, rounded down.
+func formatRemaining(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return "in " + formatSecs(uint(d/(24*time.Hour))*24*60*60)
+	case d >= time.Hour:
+		return "in " + formatSecs(uint(d/time.Hour)*60*60)
+	case d >= time.Minute:
+		return "in " + formatSecs(uint(d/time.Minute)*60)
+	default:
+		return "in less than a minute"
+	}
+}
+
+func landingPageData(info FileInfo, fileName string, now time.Time) downloadPageData {
+	data := downloadPageData{
+		Name:        fileName,
+		ContentType: info.ContentType,
+		Size:        info.Size,
+		UsesLeft:    -1,
+		Expires:     info.StoreUntil,
+		DownloadURL: "?raw=1",
+	}
+	if info.Size >= 0 {
+		data.SizeText = formatSize(uint64(info.Size))
+	}
+	if info.MaxUses != 0 {
+		data.UsesLeft = int(info.MaxUses) - int(info.Uses)
+	}
+	if !info.StoreUntil.IsZero() {
+		data.ExpiresText = formatRemaining(info.StoreUntil.Sub(now)) +
+			" (" + info.StoreUntil.UTC().Format("2006-01-02 15:04 MST") + ")"
+	}
+	return data
+}
+
+// serveLandingPage serves page with file information and download button.
+// Use is not counted.
+func (s *Server) serveLandingPage(w http.ResponseWriter, r *http.Request, info FileInfo, fileName string) {
+	data := landingPageData(info, fileName, time.Now())
+	data.AssetsPath = assetsPath(r.URL.Path)
+	s.renderPage(w, r, s.downloadPage, data)
+}
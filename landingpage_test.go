@@ -0,0 +1,107 @@
+package filedrop_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/filedrop"
+)
+
+func TestLandingPage(t *testing.T) {
+	conf := filedrop.Default
+	conf.LandingPage = true
+	conf.Limits.MaxUses = 3
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop?store-secs=7200", "text/plain", strings.NewReader(file)))
+
+	t.Run("browser", func(t *testing.T) {
+		resp := getHTML(t, c, url+"/meow.txt")
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("GET: HTTP", resp.StatusCode, resp.Status)
+		}
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+			t.Fatal("Wrong Content-Type:", resp.Header.Get("Content-Type"))
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := string(body)
+		for _, s := range []string{"<h1>meow.txt</h1>", "text/plain", strconv.Itoa(len(file)) + " B", "<td>3</td>", "in 1 hour", `href="?raw=1"`, `download="meow.txt"`} {
+			if !strings.Contains(page, s) {
+				t.Error("Page doesn't contain", s)
+			}
+		}
+		if !strings.Contains(resp.Header.Get("Vary"), "Accept") {
+			t.Error("Missing Vary header")
+		}
+	})
+	if uses := fileUses(t, serv, url); uses != 0 {
+		t.Fatal("Landing page counted as use")
+	}
+
+	t.Run("raw", func(t *testing.T) {
+		resp := getHTML(t, c, url+"/meow.txt?raw=1")
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != file {
+			t.Error("Got different file!")
+		}
+	})
+	t.Run("non-browser", func(t *testing.T) {
+		body := doGET(t, c, url)
+		if string(body) != file {
+			t.Error("Got different file!")
+		}
+	})
+	if uses := fileUses(t, serv, url); uses != 2 {
+		t.Fatal("Uses count is", uses, "but should be 2")
+	}
+
+	t.Run("uses left", func(t *testing.T) {
+		resp := getHTML(t, c, url)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(body), "<td>1</td>") {
+			t.Error("Wrong uses left count")
+		}
+		if !strings.Contains(string(body), "<h1>Shared file</h1>") {
+			t.Error("Wrong title for file without name")
+		}
+	})
+}
+
+func TestLandingPageDisabled(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	resp := getHTML(t, c, url)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != file {
+		t.Error("Got different file!")
+	}
+}
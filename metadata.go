@@ -0,0 +1,260 @@
+package filedrop
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"mime"
+
+	"github.com/pkg/errors"
+)
+
+// errMalformedImage is returned when metadata can't be stripped because
+// image structure is invalid.
+var errMalformedImage = errors.New("malformed image")
+
+// stripMetadata returns reader producing contents without EXIF, XMP and
+// other metadata, ok is false if content type is not supported.
+//
+// Returned reader should be closed to release resources if it is not
+// read until EOF.
+func stripMetadata(contents io.Reader, contentType string) (stripped io.ReadCloser, ok bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+	var strip func(out io.Writer, in io.Reader) error
+	switch mediaType {
+	case "image/jpeg":
+		strip = stripJPEG
+	case "image/png":
+		strip = stripPNG
+	default:
+		return nil, false
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(strip(pw, contents))
+	}()
+	return pr, true
+}
+
+func malformedOnEOF(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errMalformedImage
+	}
+	return err
+}
+
+const (
+	jpegTEM  = 0x01
+	jpegRST0 = 0xD0
+	jpegRST7 = 0xD7
+	jpegSOI  = 0xD8
+	jpegEOI  = 0xD9
+	jpegSOS  = 0xDA
+	jpegAPP1 = 0xE1 // EXIF (including GPS) and XMP
+	jpegAPPD = 0xED // Photoshop IRB with IPTC
+	jpegCOM  = 0xFE
+)
+
+func jpegDropped(marker byte) bool {
+	return marker == jpegAPP1 || marker == jpegAPPD || marker == jpegCOM
+}
+
+// stripJPEG copies JPEG image removing APP1, APP13 and COM segments.
+// Image data is not changed, anything after end of image is dropped.
+func stripJPEG(out io.Writer, in io.Reader) error {
+	r := bufio.NewReader(in)
+	w := bufio.NewWriter(out)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil {
+		return malformedOnEOF(err)
+	}
+	if soi[0] != 0xFF || soi[1] != jpegSOI {
+		return errMalformedImage
+	}
+	if _, err := w.Write(soi[:]); err != nil {
+		return err
+	}
+
+	var marker byte
+	for {
+		if marker == 0 {
+			var err error
+			marker, err = readJPEGMarker(r)
+			if err != nil {
+				return malformedOnEOF(err)
+			}
+		}
+
+		switch {
+		case marker == jpegEOI:
+			if _, err := w.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			return w.Flush()
+		case marker == jpegTEM || (marker >= jpegRST0 && marker <= jpegRST7):
+			// Standalone markers without length.
+			if _, err := w.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			marker = 0
+			continue
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return malformedOnEOF(err)
+		}
+		// Length includes itself.
+		n := int64(binary.BigEndian.Uint16(length[:])) - 2
+		if n < 0 {
+			return errMalformedImage
+		}
+		if jpegDropped(marker) {
+			if _, err := r.Discard(int(n)); err != nil {
+				return malformedOnEOF(err)
+			}
+			marker = 0
+			continue
+		}
+		if _, err := w.Write([]byte{0xFF, marker, length[0], length[1]}); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, n); err != nil {
+			return malformedOnEOF(err)
+		}
+
+		if marker != jpegSOS {
+			marker = 0
+			continue
+		}
+		// Entropy-coded data follows scan header, it ends with the next
+		// marker which is processed as usual.
+		var err error
+		marker, err = copyJPEGScan(w, r)
+		if err != nil {
+			return malformedOnEOF(err)
+		}
+	}
+}
+
+// readJPEGMarker reads marker, skipping fill bytes.
+func readJPEGMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, errMalformedImage
+	}
+	for b == 0xFF {
+		b, err = r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if b == 0 {
+		return 0, errMalformedImage
+	}
+	return b, nil
+}
+
+// copyJPEGScan copies entropy-coded data and returns marker that follows
+// it.
+func copyJPEGScan(w *bufio.Writer, r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0xFF {
+			if err := w.WriteByte(b); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		next, err := r.ReadByte()
+		for err == nil && next == 0xFF {
+			next, err = r.ReadByte()
+		}
+		if err != nil {
+			return 0, err
+		}
+		// Stuffed zero byte and restart markers are part of data.
+		if next == 0 || (next >= jpegRST0 && next <= jpegRST7) {
+			if _, err := w.Write([]byte{0xFF, next}); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		return next, nil
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngDropped lists chunks containing metadata: EXIF, text (including
+// XMP) and modification time.
+var pngDropped = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripPNG copies PNG image removing metadata chunks. Image data is not
+// changed, anything after end of image is dropped.
+func stripPNG(out io.Writer, in io.Reader) error {
+	r := bufio.NewReader(in)
+	w := bufio.NewWriter(out)
+
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, signature); err != nil {
+		return malformedOnEOF(err)
+	}
+	if !bytes.Equal(signature, pngSignature) {
+		return errMalformedImage
+	}
+	if _, err := w.Write(signature); err != nil {
+		return err
+	}
+
+	for {
+		// Length and type.
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return malformedOnEOF(err)
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		if length > 1<<31-1 {
+			return errMalformedImage
+		}
+		chunkType := string(header[4:])
+		// Data and CRC.
+		n := int64(length) + 4
+
+		if pngDropped[chunkType] {
+			if _, err := io.CopyN(ioutil.Discard, r, n); err != nil {
+				return malformedOnEOF(err)
+			}
+			continue
+		}
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, n); err != nil {
+			return malformedOnEOF(err)
+		}
+		if chunkType == "IEND" {
+			return w.Flush()
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package filedrop_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/filedrop"
+)
+
+const secretMetadata = "GPS 55.7558 37.6173"
+
+// jpegWithMetadata returns JPEG image with EXIF and comment segments and
+// data appended after end of image.
+func jpegWithMetadata(t *testing.T) []byte {
+	t.Helper()
+
+	img := testImage(t, "jpeg")
+	segment := func(marker byte, payload string) []byte {
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(payload)+2))
+		return append([]byte{0xFF, marker, length[0], length[1]}, payload...)
+	}
+	var buf bytes.Buffer
+	buf.Write(img[:2]) // SOI
+	buf.Write(segment(0xE1, "Exif\x00\x00"+secretMetadata))
+	buf.Write(segment(0xFE, secretMetadata))
+	buf.Write(img[2:])
+	buf.WriteString(secretMetadata)
+	return buf.Bytes()
+}
+
+// pngWithMetadata returns PNG image with text chunk.
+func pngWithMetadata(t *testing.T) []byte {
+	t.Helper()
+
+	img := testImage(t, "png")
+	data := "Comment\x00" + secretMetadata
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk[:4], uint32(len(data)))
+	copy(chunk[4:], "tEXt")
+	chunk = append(chunk, data...)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc[:]...)
+
+	// Signature and IHDR chunk go first.
+	ihdrEnd := 8 + 8 + 13 + 4
+	var buf bytes.Buffer
+	buf.Write(img[:ihdrEnd])
+	buf.Write(chunk)
+	buf.Write(img[ihdrEnd:])
+	return buf.Bytes()
+}
+
+func checkStripped(t *testing.T, serv *filedrop.Server, fileUUID string, contents []byte) {
+	t.Helper()
+
+	if bytes.Contains(contents, []byte(secretMetadata)) {
+		t.Error("Metadata is not removed")
+	}
+	img, _, err := image.Decode(bytes.NewReader(contents))
+	if err != nil {
+		t.Fatal("Image is broken:", err)
+	}
+	if size := img.Bounds().Size(); size.X != 100 || size.Y != 50 {
+		t.Error("Wrong image size:", size)
+	}
+	info, err := serv.FileInfo(fileUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Sanitized {
+		t.Error("File is not marked as sanitized")
+	}
+}
+
+func TestStripMetadata(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	cases := []struct {
+		contentType string
+		contents    []byte
+	}{
+		{"image/jpeg", jpegWithMetadata(t)},
+		{"image/png", pngWithMetadata(t)},
+	}
+	for _, case_ := range cases {
+		t.Run(case_.contentType, func(t *testing.T) {
+			url := string(doPOST(t, c, ts.URL+"/filedrop?strip-metadata=1", case_.contentType, bytes.NewReader(case_.contents)))
+			checkStripped(t, serv, url[strings.LastIndex(url, "/")+1:], doGET(t, c, url))
+		})
+	}
+}
+
+func TestStripMetadataConfig(t *testing.T) {
+	conf := filedrop.Default
+	conf.StripMetadata = true
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	t.Run("AddFile", func(t *testing.T) {
+		fileUUID, err := serv.AddFile(bytes.NewReader(pngWithMetadata(t)), "image/png", 0, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStripped(t, serv, fileUUID, doGET(t, c, ts.URL+"/filedrop/"+fileUUID))
+	})
+	t.Run("disabled per request", func(t *testing.T) {
+		contents := jpegWithMetadata(t)
+		url := string(doPOST(t, c, ts.URL+"/filedrop?strip-metadata=false", "image/jpeg", bytes.NewReader(contents)))
+		if !bytes.Equal(doGET(t, c, url), contents) {
+			t.Error("File is changed")
+		}
+		info, err := serv.FileInfo(url[strings.LastIndex(url, "/")+1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Sanitized {
+			t.Error("File is marked as sanitized")
+		}
+	})
+	t.Run("not image", func(t *testing.T) {
+		url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+		if string(doGET(t, c, url)) != file {
+			t.Error("File is changed")
+		}
+	})
+}
+
+func TestStripMetadataMalformed(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	truncated := jpegWithMetadata(t)[:100]
+	cases := []struct {
+		contentType string
+		contents    []byte
+	}{
+		{"image/jpeg", []byte(file)},
+		{"image/jpeg", truncated},
+		{"image/png", []byte(file)},
+	}
+	for _, case_ := range cases {
+		code := doPOSTFail(t, c, ts.URL+"/filedrop?strip-metadata=1", case_.contentType, bytes.NewReader(case_.contents))
+		if code != http.StatusBadRequest {
+			t.Error("POST: HTTP", code)
+		}
+	}
+	code := doPOSTFail(t, c, ts.URL+"/filedrop?strip-metadata=meow", "image/png", bytes.NewReader(testImage(t, "png")))
+	if code != http.StatusBadRequest {
+		t.Error("POST: HTTP", code)
+	}
+}
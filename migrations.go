@@ -0,0 +1,256 @@
+package filedrop
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type migration struct {
+	version     int
+	description string
+
+	// stmts maps driver name to list of statements to execute.
+	// Statements under "" key are used for drivers not listed explicitly.
+	stmts map[string][]string
+}
+
+// List of schema migrations, ordered by version. Never change
+// already released migrations, add new ones instead.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create filedrop table",
+		stmts: map[string][]string{
+			// Table may already exist in databases created before
+			// migrations were introduced.
+			"": {`CREATE TABLE IF NOT EXISTS filedrop (
+				uuid CHAR(36) PRIMARY KEY NOT NULL,
+				contentType VARCHAR(255) DEFAULT NULL,
+				uses INTEGER NOT NULL DEFAULT 0,
+				maxUses INTEGER DEFAULT NULL,
+				storeUntil BIGINT DEFAULT NULL
+			)`},
+		},
+	},
+	{
+		version:     2,
+		description: "create webhooks outbox table",
+		stmts: map[string][]string{
+			"": {`CREATE TABLE IF NOT EXISTS filedrop_outbox (
+				id CHAR(36) PRIMARY KEY NOT NULL,
+				target VARCHAR(2048) NOT NULL,
+				payload TEXT NOT NULL,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				nextAttempt BIGINT NOT NULL
+			)`},
+		},
+	},
+	{
+		version:     3,
+		description: "add size, checksum and creation time columns",
+		stmts: map[string][]string{
+			"": {
+				`ALTER TABLE filedrop ADD COLUMN size BIGINT DEFAULT NULL`,
+				`ALTER TABLE filedrop ADD COLUMN sha256 CHAR(64) DEFAULT NULL`,
+				`ALTER TABLE filedrop ADD COLUMN createdAt BIGINT DEFAULT NULL`,
+			},
+		},
+	},
+	{
+		version:     4,
+		description: "add deduplicated blobs",
+		stmts: map[string][]string{
+			"": {
+				`ALTER TABLE filedrop ADD COLUMN blobHash CHAR(64) DEFAULT NULL`,
+				`CREATE TABLE IF NOT EXISTS filedrop_blobs (
+					sha256 CHAR(64) PRIMARY KEY NOT NULL,
+					refs INTEGER NOT NULL
+				)`,
+			},
+		},
+	},
+	{
+		version:     5,
+		description: "add wrapped data key column for encrypted files",
+		stmts: map[string][]string{
+			"": {`ALTER TABLE filedrop ADD COLUMN dataKey VARCHAR(255) DEFAULT NULL`},
+		},
+	},
+	{
+		version:     6,
+		description: "add client-side encryption mode column",
+		stmts: map[string][]string{
+			"": {`ALTER TABLE filedrop ADD COLUMN encryption VARCHAR(16) DEFAULT NULL`},
+		},
+	},
+	{
+		version:     7,
+		description: "add compression column",
+		stmts: map[string][]string{
+			"": {`ALTER TABLE filedrop ADD COLUMN compression VARCHAR(16) DEFAULT NULL`},
+		},
+	},
+	{
+		version:     8,
+		description: "add download password columns",
+		stmts: map[string][]string{
+			"": {
+				`ALTER TABLE filedrop ADD COLUMN passwordHash VARCHAR(255) DEFAULT NULL`,
+				`ALTER TABLE filedrop ADD COLUMN failedAttempts INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE filedrop ADD COLUMN lockedUntil BIGINT DEFAULT NULL`,
+			},
+		},
+	},
+	{
+		version:     9,
+		description: "add metadata stripping flag column",
+		stmts: map[string][]string{
+			"": {`ALTER TABLE filedrop ADD COLUMN sanitized INTEGER NOT NULL DEFAULT 0`},
+		},
+	},
+	{
+		version:     10,
+		description: "allow file IDs shorter than UUID",
+		stmts: map[string][]string{
+			// CHAR is padded with spaces by PostgreSQL. SQLite doesn't
+			// pad values and can't alter columns.
+			"postgres": {`ALTER TABLE filedrop ALTER COLUMN uuid TYPE VARCHAR(36)`},
+			"mysql":    {`ALTER TABLE filedrop MODIFY uuid VARCHAR(36) NOT NULL`},
+			"sqlite3":  {},
+		},
+	},
+}
+
+func (m migration) stmtsFor(driver string) []string {
+	if stmts, ok := m.stmts[driver]; ok {
+		return stmts
+	}
+	return m.stmts[""]
+}
+
+// MigrationInfo describes single schema migration.
+type MigrationInfo struct {
+	Version     int
+	Description string
+	Applied     bool
+
+	// Statements are SQL statements executed by migration for used driver.
+	Statements []string
+}
+
+func (db *db) initVersionTable() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS filedrop_schema_version (
+		version INTEGER PRIMARY KEY NOT NULL,
+		appliedAt BIGINT NOT NULL
+	)`)
+	return err
+}
+
+// SchemaVersion returns version of last applied migration, 0 if none.
+func (db *db) SchemaVersion() (int, error) {
+	version := sql.NullInt64{}
+	err := db.QueryRow(`SELECT MAX(version) FROM filedrop_schema_version`).Scan(&version)
+	return int(version.Int64), err
+}
+
+// SchemaStatus returns list of all known migrations.
+func (db *db) SchemaStatus() ([]MigrationInfo, error) {
+	current, err := db.SchemaVersion()
+	if err != nil {
+		// There is no portable way to check whether table exists so assume
+		// that this is the cause. Version table is created by Migrate.
+		current = 0
+	}
+
+	res := make([]MigrationInfo, 0, len(migrations))
+	for _, m := range migrations {
+		res = append(res, MigrationInfo{
+			Version:     m.version,
+			Description: m.description,
+			Applied:     m.version <= current,
+			Statements:  m.stmtsFor(db.Driver),
+		})
+	}
+	return res, nil
+}
+
+// Migrate applies all pending migrations and returns list of them. If
+// dryRun is true, nothing is changed.
+//
+// Each migration is executed in separate transaction. Note that MySQL
+// commits DDL statements implicitly so failed migration may be
+// partially applied there.
+func (db *db) Migrate(dryRun bool) ([]MigrationInfo, error) {
+	status, err := db.SchemaStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	if !dryRun {
+		if err := db.initVersionTable(); err != nil {
+			return nil, errors.Wrap(err, "version table create")
+		}
+	}
+
+	pending := []MigrationInfo{}
+	for _, m := range status {
+		if m.Applied {
+			continue
+		}
+		if !dryRun {
+			if err := db.applyMigration(m); err != nil {
+				return pending, errors.Wrapf(err, "migration %d (%s)", m.Version, m.Description)
+			}
+			m.Applied = true
+		}
+		pending = append(pending, m)
+	}
+	return pending, nil
+}
+
+func (db *db) applyMigration(m MigrationInfo) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "tx begin")
+	}
+	defer tx.Rollback() // rollback is no-op after commit
+
+	for _, stmt := range m.Statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(db.reformatBindvars(`INSERT INTO filedrop_schema_version(version, appliedAt) VALUES (?, ?)`), m.Version, time.Now().Unix())
+	if err != nil {
+		return errors.Wrap(err, "version update")
+	}
+	return tx.Commit()
+}
+
+// SchemaStatus returns list of schema migrations and whether they are
+// applied to database specified in conf.
+func SchemaStatus(conf DBConfig) ([]MigrationInfo, error) {
+	db, err := connectDB(conf.Driver, conf.DSN)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return db.SchemaStatus()
+}
+
+// Migrate applies pending schema migrations to database specified in
+// conf and returns list of them. If dryRun is true, database is not
+// changed.
+//
+// Note that New applies migrations automatically, this function is
+// meant for manual database management.
+func Migrate(conf DBConfig, dryRun bool) ([]MigrationInfo, error) {
+	db, err := connectDB(conf.Driver, conf.DSN)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return db.Migrate(dryRun)
+}
@@ -0,0 +1,120 @@
+package filedrop_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxcpp/filedrop"
+)
+
+// Schema used before migrations were introduced.
+const legacySchema = `CREATE TABLE filedrop (
+	uuid CHAR(36) PRIMARY KEY NOT NULL,
+	contentType VARCHAR(255) DEFAULT NULL,
+	uses INTEGER NOT NULL DEFAULT 0,
+	maxUses INTEGER DEFAULT NULL,
+	storeUntil BIGINT DEFAULT NULL
+)`
+
+func TestMigrateLegacyDB(t *testing.T) {
+	if TestDSN == ":memory:" {
+		t.Skip("Can't reopen in-memory DB")
+	}
+
+	tempDir, err := ioutil.TempDir("", "filedrop-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	conf := filedrop.Default
+	conf.StorageDir = tempDir
+	conf.DB.Driver = TestDB
+	conf.DB.DSN = TestDSN
+	if TestDB == "" || TestDSN == "" {
+		conf.DB.Driver = "sqlite3"
+		conf.DB.DSN = filepath.Join(tempDir, "index.db")
+	}
+
+	// Create database as old version would.
+	rawDB, err := sql.Open(conf.DB.Driver, conf.DB.DSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"filedrop", "filedrop_outbox", "filedrop_schema_version"} {
+		rawDB.Exec(`DROP TABLE IF EXISTS ` + table)
+	}
+	if _, err := rawDB.Exec(legacySchema); err != nil {
+		t.Fatal(err)
+	}
+	fileUUID := "41a8f78c-ce06-11e8-b2ed-b083fe9824ac"
+	if _, err := rawDB.Exec(`INSERT INTO filedrop(uuid, contentType) VALUES ('` + fileUUID + `', 'text/plain')`); err != nil {
+		t.Fatal(err)
+	}
+	rawDB.Close()
+	if err := ioutil.WriteFile(filepath.Join(tempDir, fileUUID), []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := filedrop.SchemaStatus(conf.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range status {
+		if m.Applied {
+			t.Error("Migration reported as applied for legacy DB:", m.Version)
+		}
+	}
+
+	pending, err := filedrop.Migrate(conf.DB, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != len(status) {
+		t.Error("Dry-run: wrong amount of pending migrations:", len(pending))
+	}
+	status, err = filedrop.SchemaStatus(conf.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status[0].Applied {
+		t.Error("Dry-run changed schema")
+	}
+
+	serv, err := filedrop.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanServ(serv)
+
+	status, err = filedrop.SchemaStatus(conf.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range status {
+		if !m.Applied {
+			t.Error("Migration not applied:", m.Version, m.Description)
+		}
+	}
+
+	reader, contentType, err := serv.GetFile(fileUUID)
+	if err != nil {
+		t.Fatal("File from legacy DB is not accessible:", err)
+	}
+	body, _ := ioutil.ReadAll(reader)
+	if string(body) != file || contentType != "text/plain" {
+		t.Error("Got different file after migration")
+	}
+
+	// Second run should be no-op.
+	pending, err = filedrop.Migrate(conf.DB, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Error("Migrations applied twice:", pending)
+	}
+}
@@ -0,0 +1,78 @@
+package filedrop
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Modes for OffloadConfig.Mode.
+const (
+	OffloadAccelRedirect = "x-accel-redirect"
+	OffloadSendfile      = "x-sendfile"
+)
+
+func (c OffloadConfig) validate() error {
+	switch c.Mode {
+	case "", OffloadSendfile:
+		return nil
+	case OffloadAccelRedirect:
+		if c.Location == "" {
+			return errors.New("offload location is required for x-accel-redirect")
+		}
+		return nil
+	default:
+		return errors.New("unknown offload mode: " + c.Mode)
+	}
+}
+
+// canOffload checks whether file contents can be sent by reverse proxy,
+// that is, whether file is stored as is.
+func (s *Server) canOffload(info FileInfo) bool {
+	return s.Conf.Offload.Mode != "" && info.dataKey == "" && info.compression == ""
+}
+
+// offloadTarget returns value for offload header pointing to file
+// contents.
+func (s *Server) offloadTarget(info FileInfo) (string, error) {
+	storagePath := s.storagePath(info)
+	rel, err := filepath.Rel(s.Conf.StorageDir, storagePath)
+	if err != nil {
+		return "", err
+	}
+
+	location := s.Conf.Offload.Location
+	switch s.Conf.Offload.Mode {
+	case OffloadAccelRedirect:
+		return strings.TrimSuffix(location, "/") + "/" + filepath.ToSlash(rel), nil
+	case OffloadSendfile:
+		if location != "" {
+			return filepath.Join(location, rel), nil
+		}
+		return filepath.Abs(storagePath)
+	default:
+		return "", errors.New("offload is disabled")
+	}
+}
+
+// writeOffload writes response that makes reverse proxy send file
+// contents. Other headers should be already set by setFileHeaders,
+// including Content-Type and Content-Disposition, since proxy would guess
+// them from stored file name otherwise.
+func (s *Server) writeOffload(w http.ResponseWriter, info FileInfo) error {
+	target, err := s.offloadTarget(info)
+	if err != nil {
+		return err
+	}
+
+	switch s.Conf.Offload.Mode {
+	case OffloadAccelRedirect:
+		w.Header().Set("X-Accel-Redirect", target)
+	case OffloadSendfile:
+		w.Header().Set("X-Sendfile", target)
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
@@ -0,0 +1,137 @@
+package filedrop_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/filedrop"
+)
+
+func TestOffloadAccelRedirect(t *testing.T) {
+	conf := filedrop.Default
+	conf.Limits.MaxUses = 1
+	conf.Offload.Mode = filedrop.OffloadAccelRedirect
+	conf.Offload.Location = "/internal/"
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	splittenURL := strings.Split(url, "/")
+	fileUUID := splittenURL[len(splittenURL)-1]
+
+	t.Run("HEAD", func(t *testing.T) {
+		resp, err := c.Head(url + "/meow.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("HEAD: HTTP", resp.StatusCode, resp.Status)
+		}
+		if resp.Header.Get("X-Accel-Redirect") != "/internal/"+fileUUID {
+			t.Error("Wrong X-Accel-Redirect:", resp.Header.Get("X-Accel-Redirect"))
+		}
+	})
+
+	t.Run("GET", func(t *testing.T) {
+		resp, body := getWithHeader(t, c, url+"/meow.txt", "Accept", "*/*")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("GET: HTTP", resp.StatusCode, resp.Status)
+		}
+		if len(body) != 0 {
+			t.Error("Contents is sent by filedrop")
+		}
+		if resp.Header.Get("X-Accel-Redirect") != "/internal/"+fileUUID {
+			t.Error("Wrong X-Accel-Redirect:", resp.Header.Get("X-Accel-Redirect"))
+		}
+		if resp.Header.Get("Content-Type") != "text/plain" {
+			t.Error("Wrong Content-Type:", resp.Header.Get("Content-Type"))
+		}
+		if resp.Header.Get("Content-Disposition") != `inline; filename=meow.txt` {
+			t.Error("Wrong Content-Disposition:", resp.Header.Get("Content-Disposition"))
+		}
+	})
+
+	// Use is counted when request is offloaded.
+	t.Run("used up", func(t *testing.T) {
+		code := doGETFail(t, c, url)
+		if code != http.StatusNotFound {
+			t.Fatal("GET: HTTP", code)
+		}
+	})
+}
+
+func TestOffloadSendfile(t *testing.T) {
+	conf := filedrop.Default
+	conf.Offload.Mode = filedrop.OffloadSendfile
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "", strings.NewReader(file)))
+
+	resp, _ := getWithHeader(t, c, url, "Accept", "*/*")
+	target := resp.Header.Get("X-Sendfile")
+	if !filepath.IsAbs(target) {
+		t.Fatal("X-Sendfile is not an absolute path:", target)
+	}
+	contents, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != file {
+		t.Error("X-Sendfile points to different file")
+	}
+	if resp.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Error("Wrong Content-Type:", resp.Header.Get("Content-Type"))
+	}
+	if resp.Header.Get("Content-Disposition") != "inline" {
+		t.Error("Wrong Content-Disposition:", resp.Header.Get("Content-Disposition"))
+	}
+}
+
+func TestOffloadSkippedForCompressed(t *testing.T) {
+	conf := filedrop.Default
+	conf.Compression.Algorithm = filedrop.CompressionGzip
+	conf.Offload.Mode = filedrop.OffloadSendfile
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+
+	resp, body := getWithHeader(t, c, url, "Accept-Encoding", "identity")
+	if resp.Header.Get("X-Sendfile") != "" {
+		t.Error("Compressed file is offloaded")
+	}
+	if string(body) != file {
+		t.Error("Got different file!")
+	}
+}
+
+func TestOffloadInvalidConfig(t *testing.T) {
+	conf := filedrop.Default
+	conf.StorageDir = t.TempDir()
+	conf.DB.Driver = "sqlite3"
+	conf.DB.DSN = filepath.Join(conf.StorageDir, "index.db")
+	conf.Offload.Mode = filedrop.OffloadAccelRedirect
+	if _, err := filedrop.New(conf); err == nil {
+		t.Error("x-accel-redirect without location is accepted")
+	}
+
+	conf.Offload.Mode = "x-whatever"
+	if _, err := filedrop.New(conf); err == nil {
+		t.Error("Unknown mode is accepted")
+	}
+}
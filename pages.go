@@ -0,0 +1,162 @@
+package filedrop
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"io/fs"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// webFiles contains built-in page templates and static assets, they can be
+// overridden by files in Config.WebDir.
+//
+//go:embed web
+var webFiles embed.FS
+
+// assetsPrefix is URL path of static assets used by pages. IDs can't
+// start with ".", so it never conflicts with links to files.
+const assetsPrefix = "/.assets/"
+
+// assetsPath returns URL of assets directory relative to page at urlPath.
+// Relative URL is used so it works if server is behind a reverse proxy
+// that strips path prefix.
+func assetsPath(urlPath string) string {
+	depth := strings.Count(urlPath, "/") - 1
+	if depth < 0 {
+		depth = 0
+	}
+	return strings.Repeat("../", depth) + strings.TrimPrefix(assetsPrefix, "/")
+}
+
+// loadTemplate parses page template from dir (if it exists there) or
+// built-in one.
+func loadTemplate(dir, name string) (*template.Template, error) {
+	text, err := webAsset(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(name).Parse(string(text))
+	if err != nil {
+		return nil, errors.Wrap(err, "template parse")
+	}
+	return tmpl, nil
+}
+
+// webAsset reads file from dir (if it exists there) or built-in one.
+func webAsset(dir, name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrNotExist
+	}
+	if dir != "" {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err == nil {
+			return contents, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return webFiles.ReadFile("web/" + name)
+}
+
+// isBrowserNavigation checks whether request is made by browser opening
+// URL (and not by page script or non-browser client). "raw" query
+// parameter can be used to get contents instead of page.
+func isBrowserNavigation(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.URL.Query().Get("raw") != "" {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func formatSecs(secs uint) string {
+	units := []struct {
+		secs uint
+		name string
+	}{
+		{24 * 60 * 60, "day"},
+		{60 * 60, "hour"},
+		{60, "minute"},
+		{1, "second"},
+	}
+	for _, unit := range units {
+		if secs%unit.secs == 0 {
+			secs /= unit.secs
+			if secs == 1 {
+				return "1 " + unit.name
+			}
+			return strconv.FormatUint(uint64(secs), 10) + " " + unit.name + "s"
+		}
+	}
+	return ""
+}
+
+func formatSize(size uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return strconv.FormatUint(size, 10) + " B"
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + " " + units[i]
+}
+
+// renderPage executes page template and writes result.
+func (s *Server) renderPage(w http.ResponseWriter, r *http.Request, tmpl *template.Template, data interface{}) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		s.Logger.Printf("Page render failure (URL %v, IP %v): %v", r.URL.String(), r.RemoteAddr, err)
+		s.writeErr(w, r, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'self'; style-src 'self'; img-src 'self'; connect-src 'self'")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		s.Logger.Printf("I/O error (URL %v, IP %v): %v", r.URL.String(), r.RemoteAddr, err)
+	}
+}
+
+func (s *Server) serveWebAsset(w http.ResponseWriter, r *http.Request, name string) {
+	var contents []byte
+	var err error
+	if name == highlightCSSAsset && s.highlightCSS != nil {
+		contents = s.highlightCSS
+	} else {
+		contents, err = webAsset(s.Conf.WebDir, name)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.writeErr(w, r, http.StatusNotFound, "not found")
+			return
+		}
+		s.Logger.Printf("Asset read failure (URL %v, IP %v): %v", r.URL.String(), r.RemoteAddr, err)
+		s.writeErr(w, r, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(contents))
+}
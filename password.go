@@ -0,0 +1,159 @@
+package filedrop
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordHeader can be used to pass file password on upload and
+// download. Basic authentication (with any user name) is also accepted on
+// download.
+const passwordHeader = "X-Filedrop-Password"
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func uploadPassword(r *http.Request) string {
+	return r.Header.Get(passwordHeader)
+}
+
+// rejectQueryPassword writes error response if password is passed in
+// "password" query parameter. Such passwords end up in server and proxy
+// logs, so they are not accepted and URL is not logged.
+func (s *Server) rejectQueryPassword(w http.ResponseWriter, r *http.Request) bool {
+	if _, ok := r.URL.Query()["password"]; !ok {
+		return false
+	}
+	s.Logger.Printf("Password in query (URL path %v, IP %v)", r.URL.Path, r.RemoteAddr)
+	s.writeErr(w, r, http.StatusBadRequest, "password should be passed in "+passwordHeader+" header")
+	return true
+}
+
+func downloadPassword(r *http.Request) (string, bool) {
+	if password := r.Header.Get(passwordHeader); password != "" {
+		return password, true
+	}
+	_, password, ok := r.BasicAuth()
+	return password, ok
+}
+
+// checkPassword checks password for protected file and writes error
+// response if it is missing or wrong.
+//
+// After Passwords.MaxAttempts wrong passwords in a row file is locked
+// for Passwords.LockoutSecs, all requests are rejected during that time
+// without password check.
+func (s *Server) checkPassword(w http.ResponseWriter, r *http.Request, info FileInfo) bool {
+	if info.passwordHash == "" {
+		return true
+	}
+
+	now := time.Now()
+	if info.lockedUntil.After(now) {
+		s.Logger.Printf("Download of locked file (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
+		retryAfter := int(info.lockedUntil.Sub(now)/time.Second) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		s.writeErr(w, r, http.StatusTooManyRequests, "too many wrong passwords, try again later")
+		return false
+	}
+
+	password, ok := downloadPassword(r)
+	if !ok {
+		s.writePasswordPrompt(w, r, "password required")
+		return false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(info.passwordHash), []byte(password)); err != nil {
+		s.Logger.Printf("Wrong password (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
+		lockUntil := now.Add(time.Duration(s.Conf.Passwords.LockoutSecs) * time.Second)
+		locked, err := s.DB.PasswordFailed(info.UUID, s.Conf.Passwords.MaxAttempts, lockUntil)
+		if err != nil {
+			s.Logger.Printf("DB update failure (%v): %v\n", info.UUID, err)
+		}
+		if locked {
+			s.Logger.Printf("File locked until %v (URL %v, IP %v)", lockUntil, r.URL.String(), r.RemoteAddr)
+		}
+		s.writePasswordPrompt(w, r, "wrong password")
+		return false
+	}
+
+	if info.failedAttempts != 0 {
+		if err := s.DB.ResetFailedAttempts(info.UUID); err != nil {
+			s.Logger.Printf("DB update failure (%v): %v\n", info.UUID, err)
+		}
+	}
+	return true
+}
+
+// writePasswordPrompt writes 401 response that makes browser ask for
+// password. If user cancels browser prompt, HTML form is shown instead.
+func (s *Server) writePasswordPrompt(w http.ResponseWriter, r *http.Request, replyText string) {
+	// Form sends password using header, don't trigger browser prompt then.
+	if r.Header.Get(passwordHeader) == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="filedrop", charset="UTF-8"`)
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		s.writeErr(w, r, http.StatusUnauthorized, replyText)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	w.WriteHeader(http.StatusUnauthorized)
+	if _, err := w.Write([]byte(passwordPage)); err != nil {
+		s.Logger.Printf("I/O error (URL %v, IP %v): %v", r.URL.String(), r.RemoteAddr, err)
+	}
+}
+
+const passwordPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>filedrop</title>
+<style>body { font-family: sans-serif; max-width: 40em; margin: 2em auto; }</style>
+</head>
+<body>
+<h1>Password required</h1>
+<form id="form">
+<p><input type="password" id="password" autofocus required> <button type="submit">Download</button></p>
+</form>
+<p id="status"></p>
+<p><a id="link"></a></p>
+<script>
+document.getElementById('form').addEventListener('submit', async ev => {
+	ev.preventDefault();
+	const status = document.getElementById('status');
+	status.textContent = 'Downloading...';
+	try {
+		const resp = await fetch(location.href, {headers: {'` + passwordHeader + `': document.getElementById('password').value}});
+		if (resp.status === 401) {
+			status.textContent = 'Wrong password.';
+			return;
+		}
+		if (resp.status === 429) {
+			status.textContent = 'Too many wrong passwords, try again later.';
+			return;
+		}
+		if (!resp.ok) {
+			throw new Error('HTTP ' + resp.status);
+		}
+		const parts = location.pathname.split('/');
+		const link = document.getElementById('link');
+		link.href = URL.createObjectURL(await resp.blob());
+		link.download = decodeURIComponent(parts[parts.length - 1]);
+		link.textContent = 'Save ' + link.download;
+		status.textContent = '';
+		link.click();
+	} catch (e) {
+		status.textContent = 'Download failed: ' + e.message;
+	}
+});
+</script>
+</body>
+</html>
+`
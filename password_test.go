@@ -0,0 +1,225 @@
+package filedrop_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/filedrop"
+)
+
+func doGETPassword(t *testing.T, c *http.Client, url, password string) (int, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "" {
+		req.SetBasicAuth("", password)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func uploadProtected(t *testing.T, c *http.Client, url, password string) string {
+	t.Helper()
+
+	req, err := http.NewRequest("POST", url, strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Filedrop-Password", password)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal("POST: HTTP", resp.StatusCode, string(body))
+	}
+	return string(body)
+}
+
+func fileUses(t *testing.T, serv *filedrop.Server, url string) uint {
+	t.Helper()
+
+	splittenURL := strings.Split(url, "/")
+	info, err := serv.FileInfo(splittenURL[len(splittenURL)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Uses
+}
+
+func TestPasswordProtected(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := uploadProtected(t, c, ts.URL+"/filedrop", "meow")
+
+	t.Run("no password", func(t *testing.T) {
+		resp, err := c.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Error("GET: HTTP", resp.StatusCode)
+		}
+		if !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic") {
+			t.Error("Missing WWW-Authenticate header")
+		}
+	})
+	t.Run("wrong password", func(t *testing.T) {
+		if code, _ := doGETPassword(t, c, url, "woof"); code != http.StatusUnauthorized {
+			t.Error("GET: HTTP", code)
+		}
+	})
+	if uses := fileUses(t, serv, url); uses != 0 {
+		t.Error("Failed attempts counted as use:", uses)
+	}
+
+	t.Run("basic auth", func(t *testing.T) {
+		code, body := doGETPassword(t, c, url, "meow")
+		if code != http.StatusOK {
+			t.Fatal("GET: HTTP", code)
+		}
+		if string(body) != file {
+			t.Error("Got different file!")
+		}
+	})
+	t.Run("header", func(t *testing.T) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Filedrop-Password", "meow")
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Error("GET: HTTP", resp.StatusCode)
+		}
+	})
+	if uses := fileUses(t, serv, url); uses != 2 {
+		t.Error("Wrong uses count:", uses)
+	}
+}
+
+func TestPasswordQueryParam(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	logs := &bytes.Buffer{}
+	serv.Logger = log.New(logs, "", 0)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	for _, query := range []string{"?password=s3cret", "?password=s3cret&max-uses=meow"} {
+		if code := doPOSTFail(t, c, ts.URL+"/filedrop"+query, "text/plain", strings.NewReader(file)); code != http.StatusBadRequest {
+			t.Error("POST", query+": HTTP", code)
+		}
+	}
+	if strings.Contains(logs.String(), "s3cret") {
+		t.Error("Password is logged:", logs.String())
+	}
+}
+
+func TestPasswordPrompt(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := uploadProtected(t, c, ts.URL+"/filedrop", "meow")
+	resp := getHTML(t, c, url)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Error("GET: HTTP", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), `type="password"`) {
+		t.Error("Password form is not served")
+	}
+}
+
+func TestPasswordLockout(t *testing.T) {
+	conf := filedrop.Default
+	conf.Passwords.MaxAttempts = 2
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := uploadProtected(t, c, ts.URL+"/filedrop", "meow")
+	for i := 0; i < 2; i++ {
+		if code, _ := doGETPassword(t, c, url, "woof"); code != http.StatusUnauthorized {
+			t.Fatal("GET: HTTP", code)
+		}
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("", "meow")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Error("GET: HTTP", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("Missing Retry-After header")
+	}
+	if uses := fileUses(t, serv, url); uses != 0 {
+		t.Error("Locked download counted as use:", uses)
+	}
+}
+
+func TestPasswordTooLong(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	req, err := http.NewRequest("POST", ts.URL+"/filedrop", strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Filedrop-Password", strings.Repeat("a", 100))
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("POST: HTTP", resp.StatusCode)
+	}
+}
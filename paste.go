@@ -0,0 +1,164 @@
+package filedrop
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/pkg/errors"
+)
+
+const (
+	pastePageTemplate = "paste.html"
+
+	// highlightCSSAsset is generated from PasteConfig.Style.
+	highlightCSSAsset = "highlight.css"
+
+	// pasteField is a form field containing paste text.
+	pasteField = "paste"
+)
+
+func newHighlightFormatter() *chromahtml.Formatter {
+	return chromahtml.New(
+		chromahtml.WithClasses(true),
+		chromahtml.WithLineNumbers(true),
+		chromahtml.LineNumbersInTable(true),
+		chromahtml.WithLinkableLineNumbers(true, "L"),
+	)
+}
+
+// highlightCSS generates stylesheet for highlighted code.
+func highlightCSS(styleName string) ([]byte, error) {
+	style := styles.Get(styleName)
+	var buf bytes.Buffer
+	if err := newHighlightFormatter().WriteCSS(&buf, style); err != nil {
+		return nil, errors.Wrap(err, "highlight css")
+	}
+	return buf.Bytes(), nil
+}
+
+// isPasteType checks whether file with specified content type can be
+// shown as paste.
+func isPasteType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+// isPasteForm checks whether upload is made using paste form. Form is
+// marked by "paste=1" query parameter, other form-encoded bodies (like
+// ones sent by "curl --data-binary") are stored as is.
+func isPasteForm(r *http.Request) bool {
+	return r.URL.Query().Get(pasteField) == "1"
+}
+
+// parsePasteForm extracts paste text from form. Other form fields
+// (max-uses, store-secs, lang, name, slug) are added to query unless they are
+// already there.
+func parsePasteForm(r *http.Request, query url.Values) (string, error) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		return "", err
+	}
+	text := r.PostForm.Get(pasteField)
+	if text == "" {
+		return "", errors.New("empty paste")
+	}
+	for _, key := range []string{"max-uses", "store-secs", "lang", "name", "slug"} {
+		if value := r.PostForm.Get(key); value != "" && query.Get(key) == "" {
+			query.Set(key, value)
+		}
+	}
+	return text, nil
+}
+
+// pasteLexer selects lexer by lang parameter, file name or content type
+// (in that order), or by analyzing text.
+func pasteLexer(lang, fileName, contentType, text string) chroma.Lexer {
+	var lexer chroma.Lexer
+	if lang != "" {
+		lexer = lexers.Get(lang)
+	}
+	if lexer == nil && fileName != "" {
+		lexer = lexers.Match(fileName)
+	}
+	if lexer == nil && contentType != "" {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		if mediaType != "text/plain" {
+			lexer = lexers.MatchMimeType(mediaType)
+		}
+	}
+	if lexer == nil {
+		lexer = lexers.Analyse(text)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	return chroma.Coalesce(lexer)
+}
+
+// pastePageData is passed to paste page template.
+type pastePageData struct {
+	downloadPageData
+
+	// Language is a name of language used for highlighting.
+	Language string
+
+	// Code is highlighted text with line numbers.
+	Code template.HTML
+}
+
+// isPasteView checks whether browser should get paste page instead of
+// file contents.
+func (s *Server) isPasteView(r *http.Request, info FileInfo) bool {
+	if s.pastePage == nil || !isBrowserNavigation(r) {
+		return false
+	}
+	if info.Encryption != "" || info.Size < 0 || info.Size > int64(s.Conf.Paste.MaxViewSize) {
+		return false
+	}
+	return isPasteType(info.ContentType)
+}
+
+// servePaste serves paste page with highlighted contents of file.
+func (s *Server) servePaste(w http.ResponseWriter, r *http.Request, info FileInfo, fileName string, contents io.Reader) {
+	text, err := ioutil.ReadAll(contents)
+	if err != nil {
+		s.Logger.Println("Error while serving", r.RequestURI+":", err)
+		s.writeErr(w, r, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	lexer := pasteLexer(r.URL.Query().Get("lang"), fileName, info.ContentType, string(text))
+	iterator, err := lexer.Tokenise(nil, string(text))
+	if err != nil {
+		s.Logger.Println("Error while serving", r.RequestURI+":", err)
+		s.writeErr(w, r, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	var code bytes.Buffer
+	if err := newHighlightFormatter().Format(&code, styles.Get(s.Conf.Paste.Style), iterator); err != nil {
+		s.Logger.Println("Error while serving", r.RequestURI+":", err)
+		s.writeErr(w, r, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	data := pastePageData{
+		downloadPageData: landingPageData(info, fileName, time.Now()),
+		Language:         lexer.Config().Name,
+		Code:             template.HTML(code.String()),
+	}
+	data.AssetsPath = assetsPath(r.URL.Path)
+	s.renderPage(w, r, s.pastePage, data)
+}
@@ -0,0 +1,219 @@
+package filedrop_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/filedrop"
+)
+
+const goPaste = "package main\n\nfunc main() {\n\tprintln(\"meow\")\n}\n"
+
+func pasteConf() filedrop.Config {
+	conf := filedrop.Default
+	conf.Paste.Enabled = true
+	return conf
+}
+
+func getPasteHTML(t *testing.T, c *http.Client, url string) string {
+	t.Helper()
+
+	resp := getHTML(t, c, url)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("GET: HTTP", resp.StatusCode, resp.Status)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatal("Wrong Content-Type:", resp.Header.Get("Content-Type"))
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestPasteForm(t *testing.T) {
+	serv := initServ(pasteConf())
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	form := neturl.Values{"paste": {goPaste}, "name": {"main.go"}, "max-uses": {"2"}}
+	url := string(doPOST(t, c, ts.URL+"/filedrop?paste=1", "application/x-www-form-urlencoded", strings.NewReader(form.Encode())))
+	if !strings.HasSuffix(url, "/main.go") {
+		t.Fatal("Name is not added to URL:", url)
+	}
+
+	t.Run("view", func(t *testing.T) {
+		page := getPasteHTML(t, c, url)
+		for _, s := range []string{`<h1>main.go</h1>`, `Go`, `id="L3"`, `href="#L3"`, `<span class="kd">func</span>`, `href="?raw=1"`, `href="../../.assets/highlight.css"`} {
+			if !strings.Contains(page, s) {
+				t.Error("Page doesn't contain", s)
+			}
+		}
+	})
+	t.Run("raw", func(t *testing.T) {
+		resp := getHTML(t, c, url+"?raw=1")
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != goPaste {
+			t.Error("Got different paste:", string(body))
+		}
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+			t.Error("Wrong Content-Type:", resp.Header.Get("Content-Type"))
+		}
+	})
+	t.Run("used up", func(t *testing.T) {
+		resp := getHTML(t, c, url)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Error("GET: HTTP", resp.StatusCode, resp.Status)
+		}
+	})
+}
+
+func TestPasteFormLimits(t *testing.T) {
+	conf := pasteConf()
+	conf.Limits.MaxUses = 2
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	form := neturl.Values{"paste": {goPaste}, "max-uses": {"3"}}
+	code := doPOSTFail(t, c, ts.URL+"/filedrop?paste=1", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if code != http.StatusBadRequest {
+		t.Error("POST: HTTP", code)
+	}
+
+	// Query parameter takes precedence over form field.
+	form = neturl.Values{"paste": {goPaste}, "max-uses": {"2"}}
+	url := string(doPOST(t, c, ts.URL+"/filedrop?paste=1&max-uses=1", "application/x-www-form-urlencoded", strings.NewReader(form.Encode())))
+	doGET(t, c, url+"?raw=1")
+	if code := doGETFail(t, c, url+"?raw=1"); code != http.StatusNotFound {
+		t.Error("GET after last use: HTTP", code)
+	}
+}
+
+func TestPasteFormRedirect(t *testing.T) {
+	serv := initServ(pasteConf())
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	form := neturl.Values{"paste": {goPaste}}
+	req, err := http.NewRequest("POST", ts.URL+"/filedrop?paste=1", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "text/html")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatal("POST: HTTP", resp.StatusCode, resp.Status)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Location"), ts.URL+"/filedrop/") {
+		t.Error("Wrong redirect:", resp.Header.Get("Location"))
+	}
+}
+
+func TestPasteEmpty(t *testing.T) {
+	serv := initServ(pasteConf())
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	code := doPOSTFail(t, c, ts.URL+"/filedrop?paste=1", "application/x-www-form-urlencoded", strings.NewReader("paste="))
+	if code != http.StatusBadRequest {
+		t.Error("POST: HTTP", code)
+	}
+}
+
+func TestPasteRawForm(t *testing.T) {
+	serv := initServ(pasteConf())
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	// Sent with this type by "curl --data-binary".
+	body := "paste=meow&purr"
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "application/x-www-form-urlencoded", strings.NewReader(body)))
+	if got := doGET(t, c, url); string(got) != body {
+		t.Error("Got different file:", string(got))
+	}
+}
+
+func TestPasteLang(t *testing.T) {
+	serv := initServ(pasteConf())
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop?lang=python", "text/plain", strings.NewReader("def meow():\n    pass\n")))
+	if !strings.HasSuffix(url, "?lang=python") {
+		t.Fatal("Language is not added to URL:", url)
+	}
+	page := getPasteHTML(t, c, url)
+	if !strings.Contains(page, "Python") {
+		t.Error("Language is not used")
+	}
+}
+
+func TestPasteNotText(t *testing.T) {
+	serv := initServ(pasteConf())
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "application/octet-stream", strings.NewReader(file)))
+	resp := getHTML(t, c, url)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != file {
+		t.Error("Got different file!")
+	}
+}
+
+func TestPasteHighlightCSS(t *testing.T) {
+	serv := initServ(pasteConf())
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	resp, body := getWithHeader(t, c, ts.URL+"/.assets/highlight.css", "Accept", "text/css")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("GET: HTTP", resp.StatusCode, resp.Status)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/css") {
+		t.Error("Wrong Content-Type:", resp.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(body), ".chroma") {
+		t.Error("Wrong stylesheet")
+	}
+}
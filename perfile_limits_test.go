@@ -1,6 +1,10 @@
 package filedrop_test
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
@@ -41,8 +45,16 @@ func TestPerFileMaxUses(t *testing.T) {
 	}) {
 		t.FailNow()
 	}
-	if !t.Run("2 use", func(t *testing.T) {
-		doGET(t, c, url)
+	if !t.Run("2 use (fail)", func(t *testing.T) {
+		if code := doGETFail(t, c, url); code != http.StatusNotFound {
+			t.Error("GET: HTTP", code)
+		}
+	}) {
+		t.FailNow()
+	}
+
+	if !t.Run("submit with max-uses=-1 (fail)", func(t *testing.T) {
+		doPOSTFail(t, c, ts.URL+"/filedrop?max-uses=-1", "text/plain", strings.NewReader(file))
 	}) {
 		t.FailNow()
 	}
@@ -108,3 +120,207 @@ func TestUnboundedFileLimits(t *testing.T) {
 	doPOST(t, c, ts.URL+"/filedrop?store-secs=999999999", "text/plain", strings.NewReader(file))
 	doPOST(t, c, ts.URL+"/filedrop?max-uses=999999999", "text/plain", strings.NewReader(file))
 }
+
+func TestHeadNotCounted(t *testing.T) {
+	conf := filedrop.Default
+	conf.Limits.MaxUses = 1
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	for i := 0; i < 3; i++ {
+		resp, err := c.Head(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatal("HEAD: HTTP", resp.StatusCode)
+		}
+	}
+	if uses := fileUses(t, serv, url); uses != 0 {
+		t.Error("HEAD counted as use:", uses)
+	}
+
+	doGET(t, c, url)
+	if code := doGETFail(t, c, url); code != 404 {
+		t.Error("GET: HTTP", code)
+	}
+}
+
+func TestRangesCounted(t *testing.T) {
+	conf := filedrop.Default
+	conf.Limits.MaxUses = 1
+	conf.Limits.UsePolicy = filedrop.UsePolicyDelivered
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+
+	resp, body := getWithHeader(t, c, url, "Range", "bytes=0-99")
+	if resp.StatusCode != http.StatusPartialContent || string(body) != file[:100] {
+		t.Fatal("GET: HTTP", resp.StatusCode, string(body))
+	}
+	resp, _ = getWithHeader(t, c, url, "Range", "bytes=50-99")
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatal("GET: HTTP", resp.StatusCode)
+	}
+	if uses := fileUses(t, serv, url); uses != 0 {
+		t.Fatal("Partial download counted as use:", uses)
+	}
+
+	// Remaining part, now whole file is downloaded.
+	resp, body = getWithHeader(t, c, url, "Range", "bytes=100-")
+	if resp.StatusCode != http.StatusPartialContent || string(body) != file[100:] {
+		t.Fatal("GET: HTTP", resp.StatusCode, string(body))
+	}
+	if code := doGETFail(t, c, url); code != 404 {
+		t.Error("GET: HTTP", code)
+	}
+}
+
+func TestIncompleteDownloadNotCounted(t *testing.T) {
+	conf := filedrop.Default
+	conf.Limits.MaxUses = 1
+	conf.Limits.UsePolicy = filedrop.UsePolicyDelivered
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	// Big enough to not fit into socket buffers.
+	big := bytes.Repeat([]byte(file), 32*1024*1024/len(file))
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "application/octet-stream", bytes.NewReader(big)))
+
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(resp.Body, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	time.Sleep(500 * time.Millisecond)
+	if uses := fileUses(t, serv, url); uses != 0 {
+		t.Fatal("Incomplete download counted as use:", uses)
+	}
+	if body := doGET(t, c, url); !bytes.Equal(body, big) {
+		t.Error("Got different file!")
+	}
+}
+
+func getWithHeaders(t *testing.T, c *http.Client, url string, headers map[string]string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestRangesSplitBetweenClients(t *testing.T) {
+	conf := filedrop.Default
+	conf.Limits.MaxUses = 1
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	resp, _ := getWithHeaders(t, c, url, map[string]string{"Range": "bytes=0-3", "User-Agent": "uaa"})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatal("GET: HTTP", resp.StatusCode)
+	}
+	resp, _ = getWithHeaders(t, c, url, map[string]string{"Range": "bytes=4-", "User-Agent": "uab"})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("GET: HTTP", resp.StatusCode)
+	}
+}
+
+func TestUsePolicySession(t *testing.T) {
+	conf := filedrop.Default
+	conf.Limits.MaxUses = 2
+	conf.Limits.UsePolicy = filedrop.UsePolicySession
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	getWithHeader(t, c, url, "Range", "bytes=0-9")
+	getWithHeader(t, c, url, "Range", "bytes=10-19")
+	doGET(t, c, url)
+	if uses := fileUses(t, serv, url); uses != 1 {
+		t.Error("Wrong uses count:", uses)
+	}
+}
+
+func TestUsePolicySessionProxy(t *testing.T) {
+	for _, case_ := range []struct {
+		name    string
+		proxies []string
+		uses    uint
+	}{
+		{"trusted", []string{"127.0.0.1"}, 3},
+		{"untrusted", []string{"192.0.2.1"}, 1},
+	} {
+		t.Run(case_.name, func(t *testing.T) {
+			conf := filedrop.Default
+			conf.Limits.UsePolicy = filedrop.UsePolicySession
+			conf.TrustedProxies = case_.proxies
+			serv := initServ(conf)
+			ts := httptest.NewServer(serv)
+			defer cleanServ(serv)
+			defer ts.Close()
+			c := ts.Client()
+
+			url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+			for _, client := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.2"} {
+				getWithHeaders(t, c, url, map[string]string{"X-Forwarded-For": "198.51.100.1, " + client})
+			}
+			getWithHeaders(t, c, url, map[string]string{"Forwarded": `for="[2001:db8::1]:4711"`})
+			if uses := fileUses(t, serv, url); uses != case_.uses {
+				t.Error("Wrong uses count:", uses)
+			}
+		})
+	}
+}
+
+func TestUsePolicyRequest(t *testing.T) {
+	conf := filedrop.Default
+	conf.Limits.UsePolicy = filedrop.UsePolicyRequest
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	getWithHeader(t, c, url, "Range", "bytes=0-9")
+	if uses := fileUses(t, serv, url); uses != 1 {
+		t.Error("Wrong uses count:", uses)
+	}
+}
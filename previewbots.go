@@ -0,0 +1,80 @@
+package filedrop
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const previewPageTemplate = "preview.html"
+
+// defaultPreviewBots matches User-Agent of link preview crawlers used by
+// popular chat apps and social networks.
+var defaultPreviewBots = []string{
+	`Slackbot`,
+	`Slack-ImgProxy`,
+	`facebookexternalhit`,
+	`Facebot`,
+	`Twitterbot`,
+	`Discordbot`,
+	`TelegramBot`,
+	`WhatsApp`,
+	`LinkedInBot`,
+	`SkypeUriPreview`,
+	`MicrosoftPreview`,
+	`Mattermost-Bot`,
+	`Synapse`,
+	`Iframely`,
+	`Embedly`,
+	`redditbot`,
+	`vkShare`,
+	`Pinterest`,
+	`Viber`,
+	`Applebot`,
+	`bingpreview`,
+}
+
+// compilePreviewBots builds single case-insensitive regexp from patterns.
+func compilePreviewBots(patterns []string) (*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		patterns = defaultPreviewBots
+	}
+	re, err := regexp.Compile(`(?i)(?:` + strings.Join(patterns, `)|(?:`) + `)`)
+	if err != nil {
+		return nil, errors.Wrap(err, "user agent patterns")
+	}
+	return re, nil
+}
+
+// isPreviewBot checks whether request is made by known link preview
+// crawler.
+func (s *Server) isPreviewBot(r *http.Request) bool {
+	return s.previewBots != nil && s.previewBots.MatchString(r.UserAgent())
+}
+
+// isRangeProbe checks whether request is a probe for file type made by
+// preview crawler, that is a single range at the beginning of the file
+// which is not larger than PreviewBots.ProbeBytes and doesn't cover the
+// whole file. Other clients could download file in such chunks without
+// counting a use.
+func (s *Server) isRangeProbe(r *http.Request, size int64) bool {
+	if !s.isPreviewBot(r) || r.Method != http.MethodGet || size <= 0 {
+		return false
+	}
+	ranges := parseRanges(r.Header.Get("Range"), size)
+	if len(ranges) != 1 || ranges[0].start != 0 {
+		return false
+	}
+	return ranges[0].end < size && ranges[0].end <= int64(s.Conf.PreviewBots.ProbeBytes)
+}
+
+// servePreviewStub serves page with OpenGraph metadata instead of file
+// contents. Use is not counted.
+func (s *Server) servePreviewStub(w http.ResponseWriter, r *http.Request, info FileInfo, fileName string) {
+	s.dbgLog("Serving preview stub for", info.UUID, "to", r.UserAgent())
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	s.renderPage(w, r, s.previewPage, landingPageData(info, fileName, time.Now()))
+}
@@ -0,0 +1,179 @@
+package filedrop_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/filedrop"
+)
+
+const slackUA = "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"
+
+func TestPreviewBots(t *testing.T) {
+	conf := filedrop.Default
+	conf.Limits.MaxUses = 1
+	conf.PreviewBots.Enabled = true
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+
+	t.Run("stub", func(t *testing.T) {
+		resp, body := getWithHeader(t, c, url+"/meow.txt", "User-Agent", slackUA)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("GET: HTTP", resp.StatusCode, resp.Status)
+		}
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+			t.Fatal("Wrong Content-Type:", resp.Header.Get("Content-Type"))
+		}
+		for _, s := range []string{`<meta property="og:title" content="meow.txt">`, `downloads left: 1`} {
+			if !strings.Contains(string(body), s) {
+				t.Error("Stub doesn't contain", s)
+			}
+		}
+	})
+	if uses := fileUses(t, serv, url); uses != 0 {
+		t.Fatal("Preview counted as use")
+	}
+
+	t.Run("recipient", func(t *testing.T) {
+		body := doGET(t, c, url)
+		if string(body) != file {
+			t.Error("Got different file!")
+		}
+	})
+}
+
+func TestPreviewBotsCustomPatterns(t *testing.T) {
+	conf := filedrop.Default
+	conf.PreviewBots.Enabled = true
+	conf.PreviewBots.UserAgents = []string{`^MeowBot/\d+`}
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+
+	_, body := getWithHeader(t, c, url, "User-Agent", "meowbot/2")
+	if string(body) == file {
+		t.Error("Custom pattern is not used")
+	}
+	_, body = getWithHeader(t, c, url, "User-Agent", slackUA)
+	if string(body) != file {
+		t.Error("Default patterns are used together with custom ones")
+	}
+}
+
+func getRange(t *testing.T, c *http.Client, url, userAgent, ranges string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Range", ranges)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestPreviewBotsRangeProbe(t *testing.T) {
+	conf := filedrop.Default
+	conf.Limits.UsePolicy = filedrop.UsePolicyRequest
+	conf.PreviewBots.Enabled = true
+	conf.PreviewBots.ProbeBytes = 100
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+
+	for i := 0; i < 2; i++ {
+		resp, body := getRange(t, c, url, slackUA, "bytes=0-99")
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Fatal("GET: HTTP", resp.StatusCode, resp.Status)
+		}
+		if string(body) != file[:100] {
+			t.Error("Got different range:", string(body))
+		}
+	}
+	if uses := fileUses(t, serv, url); uses != 0 {
+		t.Fatal("Range probe counted as use")
+	}
+
+	// Too big for probe, stub is served instead.
+	_, body := getRange(t, c, url, slackUA, "bytes=0-100")
+	if strings.HasPrefix(file, string(body)) {
+		t.Error("Contents is served for too big probe")
+	}
+	if uses := fileUses(t, serv, url); uses != 0 {
+		t.Fatal("Stub counted as use")
+	}
+
+	// Ranges requested by other clients are counted.
+	getRange(t, c, url, "Go-http-client/1.1", "bytes=0-99")
+	if uses := fileUses(t, serv, url); uses != 1 {
+		t.Fatal("Uses count is", uses, "but should be 1")
+	}
+	getRange(t, c, url, "Go-http-client/1.1", "bytes=10-19")
+	if uses := fileUses(t, serv, url); uses != 2 {
+		t.Fatal("Uses count is", uses, "but should be 2")
+	}
+}
+
+func TestRangeProbeNotBot(t *testing.T) {
+	conf := filedrop.Default
+	conf.Limits.UsePolicy = filedrop.UsePolicyRequest
+	conf.Limits.MaxUses = 1
+	conf.PreviewBots.Enabled = true
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+
+	resp, _ := getRange(t, c, url, "curl/8.0", "bytes=0-99")
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatal("GET: HTTP", resp.StatusCode, resp.Status)
+	}
+	for i := 0; i < 4; i++ {
+		resp, _ := getRange(t, c, url, "curl/8.0", "bytes=0-99")
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatal("Repeated probe", i, "after last use: HTTP", resp.StatusCode, resp.Status)
+		}
+	}
+}
+
+func TestPreviewBotsDisabled(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	_, body := getWithHeader(t, c, url, "User-Agent", slackUA)
+	if string(body) != file {
+		t.Error("Got different file!")
+	}
+}
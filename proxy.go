@@ -0,0 +1,209 @@
+package filedrop
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// trustedUnix is Config.TrustedProxies entry matching connections over
+// Unix sockets.
+const trustedUnix = "unix"
+
+// parsePublicURL parses and checks base URL specified in option.
+func parsePublicURL(option, raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, option)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New(option + ": absolute http or https URL is required")
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, errors.New(option + ": query and fragment are not allowed")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u, nil
+}
+
+// parseTrustedProxies parses list of CIDRs and IP addresses. Unix sockets
+// are trusted if list contains "unix".
+func parseTrustedProxies(list []string) (nets []*net.IPNet, unix bool, err error) {
+	for _, entry := range list {
+		if entry == trustedUnix {
+			unix = true
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, false, errors.New("trusted_proxies: invalid IP address: " + entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, false, errors.Wrap(err, "trusted_proxies")
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, unix, nil
+}
+
+// fromTrustedProxy checks whether request is received from proxy listed
+// in Config.TrustedProxies.
+func (s *Server) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// Unix sockets have empty or "@" address.
+		return s.trustUnix && (host == "" || host == "@")
+	}
+	for _, ipNet := range s.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastValue returns last comma-separated value of header. If there are
+// several proxies, value appended by the nearest one is used, since
+// preceding ones may come from client.
+func lastValue(header http.Header, key string) string {
+	values := header[http.CanonicalHeaderKey(key)]
+	if len(values) == 0 {
+		return ""
+	}
+	parts := strings.Split(values[len(values)-1], ",")
+	return strings.TrimSpace(parts[len(parts)-1])
+}
+
+// forwardedParams returns parameters of last element of RFC 7239
+// Forwarded header.
+func forwardedParams(header http.Header) map[string]string {
+	element := lastValue(header, "Forwarded")
+	if element == "" {
+		return nil
+	}
+	params := map[string]string{}
+	for _, pair := range strings.Split(element, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := kv[1]
+		if strings.HasPrefix(value, `"`) {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				continue
+			}
+			value = unquoted
+		}
+		params[strings.ToLower(kv[0])] = value
+	}
+	return params
+}
+
+func validForwardedHost(host string) bool {
+	return host != "" && !strings.ContainsAny(host, "/\\@?# ")
+}
+
+// requestHost returns host used by client to reach filedrop, it is taken
+// from Forwarded or X-Forwarded-Host header if request comes from trusted
+// proxy.
+func (s *Server) requestHost(r *http.Request) string {
+	if !s.fromTrustedProxy(r) {
+		return r.Host
+	}
+	if host := forwardedParams(r.Header)["host"]; validForwardedHost(host) {
+		return host
+	}
+	if host := lastValue(r.Header, "X-Forwarded-Host"); validForwardedHost(host) {
+		return host
+	}
+	return r.Host
+}
+
+// clientIP returns address of client, it is taken from Forwarded or
+// X-Forwarded-For header if request comes from trusted proxy.
+func (s *Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !s.fromTrustedProxy(r) {
+		return host
+	}
+	if ip := forwardedIP(forwardedParams(r.Header)["for"]); ip != "" {
+		return ip
+	}
+	if ip := forwardedIP(lastValue(r.Header, "X-Forwarded-For")); ip != "" {
+		return ip
+	}
+	return host
+}
+
+// forwardedIP extracts IP address from Forwarded "for" parameter or
+// X-Forwarded-For value, empty string is returned for obfuscated or
+// invalid ones.
+func forwardedIP(value string) string {
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	if ip := net.ParseIP(value); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// requestOrigin returns scheme, host and path prefix used by client to
+// reach filedrop. Prefix is prepended to request path to get public URL.
+//
+// Config.BaseURL is used if set. Otherwise, they are taken from request,
+// Forwarded and X-Forwarded-* headers of trusted proxies override it.
+func (s *Server) requestOrigin(r *http.Request) (scheme, host, prefix string) {
+	if s.baseURL != nil {
+		return s.baseURL.Scheme, s.baseURL.Host, s.baseURL.Path
+	}
+
+	if s.Conf.HTTPSDownstream || r.TLS != nil {
+		scheme = "https"
+	} else {
+		scheme = "http"
+	}
+	host = s.requestHost(r)
+	if s.fromTrustedProxy(r) {
+		proto := forwardedParams(r.Header)["proto"]
+		if proto == "" {
+			proto = lastValue(r.Header, "X-Forwarded-Proto")
+		}
+		if proto = strings.ToLower(proto); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if p := lastValue(r.Header, "X-Forwarded-Prefix"); strings.HasPrefix(p, "/") {
+			prefix = strings.TrimSuffix(p, "/")
+		}
+	}
+	// Explicit override, kept for compatibility.
+	if r.Header.Get("X-HTTPS-Downstream") == "1" {
+		scheme = "https"
+	} else if r.Header.Get("X-HTTPS-Downstream") == "0" {
+		scheme = "http"
+	}
+	return scheme, host, prefix
+}
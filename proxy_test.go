@@ -0,0 +1,179 @@
+package filedrop_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/filedrop"
+)
+
+func postWithHeaders(t *testing.T, c *http.Client, url string, headers map[string]string) string {
+	t.Helper()
+
+	req, err := http.NewRequest("POST", url, strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal("POST: HTTP", resp.StatusCode, resp.Status)
+	}
+	return string(body)
+}
+
+func checkLink(t *testing.T, link, prefix string) {
+	t.Helper()
+
+	re := regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + "/[0-9a-f-]{36}$")
+	if !re.MatchString(link) {
+		t.Error("Wrong link:", link, "expected prefix:", prefix)
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	conf := filedrop.Default
+	conf.BaseURL = "https://example.org/files/"
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	link := postWithHeaders(t, c, ts.URL+"/filedrop", map[string]string{"X-Forwarded-Host": "evil.example.com"})
+	checkLink(t, link, "https://example.org/files/filedrop")
+}
+
+func TestTrustedProxyHeaders(t *testing.T) {
+	conf := filedrop.Default
+	conf.TrustedProxies = []string{"10.0.0.1", "127.0.0.0/8"}
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	cases := []struct {
+		name    string
+		headers map[string]string
+		prefix  string
+	}{
+		{
+			"none",
+			nil,
+			ts.URL + "/filedrop",
+		},
+		{
+			"x-forwarded",
+			map[string]string{
+				"X-Forwarded-Proto":  "https",
+				"X-Forwarded-Host":   "example.org",
+				"X-Forwarded-Prefix": "/files/",
+			},
+			"https://example.org/files/filedrop",
+		},
+		{
+			"forwarded",
+			map[string]string{"Forwarded": `for=192.0.2.1;proto=https;host="example.org:8443"`},
+			"https://example.org:8443/filedrop",
+		},
+		{
+			// Elements added by client are ignored.
+			"forwarded chain",
+			map[string]string{
+				"Forwarded":        "proto=http;host=evil.example.com, for=192.0.2.1;proto=https;host=example.org",
+				"X-Forwarded-Host": "evil.example.com",
+			},
+			"https://example.org/filedrop",
+		},
+		{
+			"invalid",
+			map[string]string{
+				"X-Forwarded-Proto": "javascript",
+				"X-Forwarded-Host":  "evil.example.com/path",
+			},
+			ts.URL + "/filedrop",
+		},
+	}
+	for _, case_ := range cases {
+		t.Run(case_.name, func(t *testing.T) {
+			checkLink(t, postWithHeaders(t, c, ts.URL+"/filedrop", case_.headers), case_.prefix)
+		})
+	}
+}
+
+func TestUntrustedProxyHeaders(t *testing.T) {
+	conf := filedrop.Default
+	conf.TrustedProxies = []string{"10.0.0.0/8", "unix"}
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	link := postWithHeaders(t, c, ts.URL+"/filedrop", map[string]string{
+		"Forwarded":          "proto=https;host=example.org",
+		"X-Forwarded-Proto":  "https",
+		"X-Forwarded-Host":   "example.org",
+		"X-Forwarded-Prefix": "/files",
+	})
+	checkLink(t, link, ts.URL+"/filedrop")
+}
+
+func TestTrustedProxyDownloadHost(t *testing.T) {
+	conf := filedrop.Default
+	conf.DownloadURL = "https://files.example.org"
+	conf.TrustedProxies = []string{"127.0.0.1"}
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	link := postWithHeaders(t, c, ts.URL+"/filedrop", nil)
+	checkLink(t, link, "https://files.example.org")
+
+	req, err := http.NewRequest("GET", ts.URL+strings.TrimPrefix(link, "https://files.example.org"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-Host", "files.example.org")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error("GET: HTTP", resp.StatusCode, resp.Status)
+	}
+}
+
+func TestTrustedProxiesInvalid(t *testing.T) {
+	for _, entry := range []string{"meow", "10.0.0.0/33"} {
+		conf := filedrop.Default
+		conf.TrustedProxies = []string{entry}
+		if _, err := filedrop.New(conf); err == nil {
+			t.Error("No error for", entry)
+		}
+	}
+	conf := filedrop.Default
+	conf.BaseURL = "/files"
+	if _, err := filedrop.New(conf); err == nil {
+		t.Error("No error for relative base_url")
+	}
+}
@@ -2,24 +2,36 @@ package filedrop
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"html/template"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gofrs/uuid"
 	"github.com/pkg/errors"
 )
 
 var ErrFileDoesntExists = errors.New("file doesn't exists")
 
+// ErrFileCorrupted is returned if stored file doesn't match recorded
+// meta-information.
+var ErrFileCorrupted = errors.New("stored file is corrupted")
+
 // Main filedrop server structure, implements http.Handler.
 type Server struct {
 	DB          *db
@@ -28,6 +40,48 @@ type Server struct {
 	DebugLogger *log.Logger
 
 	fileCleanerStopChan chan bool
+	// Time of last clean-up loop iteration, time.Time.
+	cleanerHeartbeat atomic.Value
+
+	eventSinks []EventSink
+	hooks      hooks
+
+	// blobLocks serialize creation and removal of blob files, see
+	// blobLock.
+	blobLocks [64]sync.Mutex
+
+	// masterKey is used to wrap data keys of encrypted files, nil if
+	// encryption is not configured.
+	masterKey []byte
+
+	downloads *downloadSessions
+
+	// Parsed page templates, nil if page is disabled.
+	uploadPage   *template.Template
+	downloadPage *template.Template
+	previewPage  *template.Template
+	pastePage    *template.Template
+
+	// highlightCSS is a stylesheet for paste page generated from
+	// Paste.Style.
+	highlightCSS []byte
+
+	// previewBots matches User-Agent of link preview crawlers, nil if
+	// detection is disabled.
+	previewBots *regexp.Regexp
+
+	// downloadURL is parsed Conf.DownloadURL, nil if files are served
+	// from any host.
+	downloadURL *url.URL
+	// baseURL is parsed Conf.BaseURL, nil if links are built from request.
+	baseURL *url.URL
+
+	// Parsed Conf.TrustedProxies.
+	trustedProxies []*net.IPNet
+	trustUnix      bool
+
+	// idGen generates IDs of uploaded files.
+	idGen IDGenerator
 }
 
 // Create and initialize new server instance using passed configuration.
@@ -40,20 +94,154 @@ func New(conf Config) (*Server, error) {
 
 	s.Conf = conf
 
+	if conf.Encryption.Enabled() {
+		if conf.Dedup {
+			return nil, errors.New("dedup can't be used together with encryption")
+		}
+		s.masterKey, err = conf.Encryption.Key()
+		if err != nil {
+			return nil, errors.Wrap(err, "master key")
+		}
+	}
+
+	if err := conf.Compression.validate(); err != nil {
+		return nil, err
+	}
+	if conf.Compression.Enabled() && conf.Dedup {
+		return nil, errors.New("dedup can't be used together with compression")
+	}
+	if err := conf.Offload.validate(); err != nil {
+		return nil, err
+	}
+	if err := conf.ContentTypes.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateWebhooks(conf.Webhooks); err != nil {
+		return nil, err
+	}
+	if conf.DownloadURL != "" {
+		s.downloadURL, err = parsePublicURL("download_url", conf.DownloadURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conf.BaseURL != "" {
+		s.baseURL, err = parsePublicURL("base_url", conf.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.trustedProxies, s.trustUnix, err = parseTrustedProxies(conf.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	s.idGen, err = newIDGenerator(conf.IDs)
+	if err != nil {
+		return nil, err
+	}
+	if conf.UploadPage {
+		s.uploadPage, err = loadTemplate(conf.WebDir, uploadPageTemplate)
+		if err != nil {
+			return nil, errors.Wrap(err, "upload page")
+		}
+	}
+	if conf.LandingPage {
+		s.downloadPage, err = loadTemplate(conf.WebDir, downloadPageTemplate)
+		if err != nil {
+			return nil, errors.Wrap(err, "landing page")
+		}
+	}
+	if conf.PreviewBots.Enabled {
+		s.previewBots, err = compilePreviewBots(conf.PreviewBots.UserAgents)
+		if err != nil {
+			return nil, err
+		}
+		s.previewPage, err = loadTemplate(conf.WebDir, previewPageTemplate)
+		if err != nil {
+			return nil, errors.Wrap(err, "preview page")
+		}
+	}
+
+	if conf.Paste.Enabled {
+		s.pastePage, err = loadTemplate(conf.WebDir, pastePageTemplate)
+		if err != nil {
+			return nil, errors.Wrap(err, "paste page")
+		}
+		if s.Conf.Paste.Style == "" {
+			s.Conf.Paste.Style = "github"
+		}
+		s.highlightCSS, err = highlightCSS(s.Conf.Paste.Style)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if err := os.MkdirAll(conf.StorageDir, os.ModePerm); err != nil {
 		return nil, err
 	}
+	if conf.Dedup {
+		if err := os.MkdirAll(s.blobsDir(), os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Thumbnails.Enabled {
+		if err := os.MkdirAll(s.thumbnailsDir(), os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
 	if err := s.testPerms(); err != nil {
 		return nil, err
 	}
 
+	if s.Conf.CleanupIntervalSecs == 0 {
+		s.Conf.CleanupIntervalSecs = 60
+	}
+	if s.Conf.Limits.UsePolicy == "" {
+		s.Conf.Limits.UsePolicy = UsePolicyRequest
+	}
+	if err := validUsePolicy(s.Conf.Limits.UsePolicy); err != nil {
+		return nil, err
+	}
+	if s.Conf.Limits.UseSessionSecs == 0 {
+		s.Conf.Limits.UseSessionSecs = 3600
+	}
+	s.downloads = newDownloadSessions(time.Duration(s.Conf.Limits.UseSessionSecs) * time.Second)
+	if s.Conf.Passwords.MaxAttempts == 0 {
+		s.Conf.Passwords.MaxAttempts = 5
+	}
+	if s.Conf.Passwords.LockoutSecs == 0 {
+		s.Conf.Passwords.LockoutSecs = 900
+	}
+	if s.Conf.ContentTypes.DangerousAction == "" {
+		s.Conf.ContentTypes.DangerousAction = DangerousAttachment
+	}
+	if s.Conf.PreviewBots.ProbeBytes == 0 {
+		s.Conf.PreviewBots.ProbeBytes = 65536
+	}
+	if s.Conf.Paste.MaxViewSize == 0 {
+		s.Conf.Paste.MaxViewSize = 1 << 20
+	}
+	if len(s.Conf.Thumbnails.Widths) == 0 {
+		s.Conf.Thumbnails.Widths = defaultThumbnailWidths
+	}
+	if s.Conf.Thumbnails.MaxPixels == 0 {
+		s.Conf.Thumbnails.MaxPixels = 50000000
+	}
+	s.cleanerHeartbeat.Store(time.Now())
 	s.fileCleanerStopChan = make(chan bool)
 	s.Logger = log.New(os.Stderr, "filedrop ", log.LstdFlags)
 	s.DB, err = openDB(conf.DB.Driver, conf.DB.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(conf.Webhooks) != 0 {
+		s.AddEventSink(newWebhookSink(s, conf.Webhooks))
+	}
 
 	go s.fileCleaner()
 
-	return s, err
+	return s, nil
 }
 
 func (s *Server) dbgLog(v ...interface{}) {
@@ -63,13 +251,13 @@ func (s *Server) dbgLog(v ...interface{}) {
 }
 
 func (s *Server) testPerms() error {
-	testPath := filepath.Join(s.Conf.StorageDir, "test_file")
-
-	// Check write permissions.
-	f, err := os.Create(testPath)
+	// Check write permissions. Unique name is used because it is also
+	// called by concurrent readiness checks.
+	f, err := ioutil.TempFile(s.Conf.StorageDir, "test_file")
 	if err != nil {
 		return err
 	}
+	testPath := f.Name()
 	f.Close()
 
 	// Check read permissions.
@@ -83,61 +271,253 @@ func (s *Server) testPerms() error {
 	return os.Remove(testPath)
 }
 
-// AddFile adds file to storage and returns assigned UUID which can be directly
+// AddFile adds file to storage and returns assigned ID which can be directly
 // substituted into URL.
 func (s *Server) AddFile(contents io.Reader, contentType string, maxUses uint, storeUntil time.Time) (string, error) {
-	fileUUID, err := uuid.NewV4()
+	info, err := s.addFile(contents, FileInfo{
+		ContentType: contentType,
+		MaxUses:     maxUses,
+		StoreUntil:  storeUntil,
+	}, s.Conf.StripMetadata)
+	return info.UUID, err
+}
+
+// addFile is AddFile that takes and returns meta-information as FileInfo.
+// Size, SHA256, CreatedAt and Sanitized are filled by it. UUID is generated
+// unless set by caller, ErrIDTaken is returned if it is already used.
+//
+// If strip is true, metadata is removed from supported images.
+func (s *Server) addFile(contents io.Reader, info FileInfo, strip bool) (FileInfo, error) {
+	fileID := info.UUID
+	var err error
+	if fileID == "" {
+		fileID, err = s.newFileID()
+		if err != nil {
+			return FileInfo{}, err
+		}
+	} else {
+		taken, err := s.idTaken(fileID)
+		if err != nil {
+			return FileInfo{}, err
+		}
+		if taken {
+			return FileInfo{}, ErrIDTaken
+		}
+	}
+	outLocation := filepath.Join(s.Conf.StorageDir, fileID)
+
+	var file *os.File
+	if s.Conf.Dedup {
+		// Hash is not known yet, so write to temporary file first.
+		file, err = ioutil.TempFile(s.Conf.StorageDir, "upload-")
+	} else {
+		// Fails if ID is taken by concurrent upload.
+		file, err = os.OpenFile(outLocation, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			return FileInfo{}, ErrIDTaken
+		}
+	}
 	if err != nil {
-		return "", errors.Wrap(err, "UUID generation")
+		s.Logger.Printf("File create failure (%v): %v\n", fileID, err)
+		return FileInfo{}, errors.Wrap(err, "file open")
+	}
+	defer file.Close()
+
+	// Files encrypted by client are opaque.
+	if strip && info.Encryption == "" {
+		if stripped, ok := stripMetadata(contents, info.ContentType); ok {
+			defer stripped.Close()
+			contents = stripped
+			info.Sanitized = true
+		}
 	}
-	outLocation := filepath.Join(s.Conf.StorageDir, fileUUID.String())
 
-	_, err = os.Stat(outLocation)
-	if err == nil {
-		s.Logger.Println("UUID collision detected:", fileUUID)
-		return "", errors.New("UUID collision detected")
+	var out io.Writer = file
+	var encWriter io.WriteCloser
+	var wrappedKey string
+	if s.masterKey != nil {
+		dataKey := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+			os.Remove(file.Name())
+			return FileInfo{}, errors.Wrap(err, "data key generation")
+		}
+		wrappedKey, err = wrapKey(s.masterKey, dataKey, fileID)
+		if err != nil {
+			os.Remove(file.Name())
+			return FileInfo{}, errors.Wrap(err, "data key wrap")
+		}
+		encWriter, err = newEncryptingWriter(file, dataKey)
+		if err != nil {
+			os.Remove(file.Name())
+			s.Logger.Printf("File write failure (%v): %v\n", fileID, err)
+			return FileInfo{}, errors.Wrap(err, "file write")
+		}
+		out = encWriter
 	}
 
-	file, err := os.Create(outLocation)
+	var compWriter io.WriteCloser
+	if s.Conf.Compression.Enabled() && info.Encryption == "" && s.Conf.Compression.compressible(info.ContentType) {
+		// Don't bother with files that are too small to benefit from compression.
+		head := make([]byte, s.Conf.Compression.MinSize)
+		n, err := io.ReadFull(contents, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			os.Remove(file.Name())
+			s.Logger.Printf("File write failure (%v): %v\n", fileID, err)
+			return FileInfo{}, errors.Wrap(err, "file write")
+		}
+		contents = io.MultiReader(bytes.NewReader(head[:n]), contents)
+
+		if err == nil {
+			compWriter, err = newCompressor(out, s.Conf.Compression.Algorithm, s.Conf.Compression.Level)
+			if err != nil {
+				os.Remove(file.Name())
+				return FileInfo{}, errors.Wrap(err, "compressor init")
+			}
+			out = compWriter
+			info.compression = s.Conf.Compression.Algorithm
+		}
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hasher), contents)
+	if err == nil && compWriter != nil {
+		err = compWriter.Close()
+	}
+	if err == nil && encWriter != nil {
+		err = encWriter.Close()
+	}
 	if err != nil {
-		s.Logger.Printf("File create failure (%v): %v\n", fileUUID, err)
-		return "", errors.Wrap(err, "file open")
+		os.Remove(file.Name())
+		s.Logger.Printf("File write failure (%v): %v\n", fileID, err)
+		return FileInfo{}, errors.Wrap(err, "file write")
 	}
-	if _, err := io.Copy(file, contents); err != nil {
-		s.Logger.Printf("File write failure (%v): %v\n", fileUUID, err)
-		return "", errors.Wrap(err, "file write")
+
+	info.UUID = fileID
+	info.Size = size
+	info.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	// Stored with second precision.
+	info.CreatedAt = time.Now().Truncate(time.Second)
+	info.dataKey = wrappedKey
+	if s.Conf.Dedup {
+		file.Close()
+		err = s.addBlobFile(file.Name(), info)
+	} else {
+		err = s.DB.AddFile(nil, info)
+		if err != nil {
+			os.Remove(outLocation)
+		}
 	}
-	if err := s.DB.AddFile(nil, fileUUID.String(), contentType, maxUses, storeUntil); err != nil {
-		os.Remove(outLocation)
-		s.Logger.Printf("DB add failure (%v, %v, %v, %v): %v\n", fileUUID, contentType, maxUses, storeUntil, err)
-		return "", errors.Wrap(err, "db add")
+	if err != nil {
+		if taken, takenErr := s.idTaken(fileID); takenErr == nil && taken {
+			// Primary key conflict with concurrent upload.
+			return FileInfo{}, ErrIDTaken
+		}
+		s.Logger.Printf("DB add failure (%v, %v, %v, %v): %v\n", fileID, info.ContentType, info.MaxUses, info.StoreUntil, err)
+		return FileInfo{}, errors.Wrap(err, "db add")
 	}
 
-	return fileUUID.String(), nil
+	s.publish(EventUploaded, info)
+
+	return info, nil
 }
 
 // RemoveFile removes file from database and underlying storage.
 func (s *Server) RemoveFile(fileUUID string) error {
-	return s.removeFile(nil, fileUUID)
+	info, err := s.DB.FileInfo(nil, fileUUID)
+	if err != nil {
+		info = FileInfo{UUID: fileUUID, Size: -1}
+	}
+	if err := s.removeFile(fileUUID); err != nil {
+		return err
+	}
+	s.fileRemoved(info, false)
+	return nil
 }
 
-func (s *Server) removeFile(tx *sql.Tx, fileUUID string) error {
-	fileLocation := filepath.Join(s.Conf.StorageDir, fileUUID)
+// FileInfo returns meta-information about stored file without any
+// side-effects.
+func (s *Server) FileInfo(fileUUID string) (FileInfo, error) {
+	if !validFileID(fileUUID) {
+		return FileInfo{}, ErrFileDoesntExists
+	}
+	info, err := s.DB.FileInfo(nil, fileUUID)
+	if err == sql.ErrNoRows {
+		return info, ErrFileDoesntExists
+	}
+	return info, err
+}
+
+func (s *Server) removeFile(fileUUID string) error {
+	if !validFileID(fileUUID) {
+		return errors.New("invalid file ID: " + fileUUID)
+	}
 
-	// Just to check validity.
-	_, err := uuid.FromString(fileUUID)
+	// Transaction is required to keep blob reference counters
+	// consistent, it can conflict with concurrent upload of the same blob.
+	for i := 0; ; i++ {
+		info, remove, err := s.tryRemoveFile(fileUUID)
+		if err == nil {
+			return s.removeStored(info, remove)
+		}
+		if !s.Conf.Dedup || i == blobTxRetries-1 {
+			return err
+		}
+		s.dbgLog("Blob transaction failed, retrying:", err)
+		time.Sleep(time.Duration(i+1) * 10 * time.Millisecond)
+	}
+}
+
+func (s *Server) tryRemoveFile(fileUUID string) (FileInfo, bool, error) {
+	tx, err := s.DB.Begin()
 	if err != nil {
-		return errors.Wrap(err, "uuid parse")
+		return FileInfo{}, false, errors.Wrap(err, "tx begin")
+	}
+	defer tx.Rollback() // rollback is no-op after commit
+
+	info, remove, err := s.removeFileTx(tx, fileUUID)
+	if err != nil {
+		return FileInfo{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return FileInfo{}, false, errors.Wrap(err, "tx commit")
+	}
+	return info, remove, nil
+}
+
+// removeFileTx removes DB entry of file and releases its contents. Stored
+// contents should be removed using removeStored after commit if remove is
+// true, so it is kept if transaction fails.
+func (s *Server) removeFileTx(tx *sql.Tx, fileUUID string) (info FileInfo, remove bool, err error) {
+	info, err = s.DB.FileInfo(tx, fileUUID)
+	if err != nil && err != sql.ErrNoRows {
+		s.Logger.Printf("DB query failure (%v): %v\n", fileUUID, err)
+		return FileInfo{}, false, errors.Wrap(err, "db query")
 	}
 
 	if err := s.DB.RemoveFile(tx, fileUUID); err != nil {
 		s.Logger.Printf("DB remove failure (%v): %v\n", fileUUID, err)
-		return errors.Wrap(err, "db remove")
+		return FileInfo{}, false, errors.Wrap(err, "db remove")
+	}
+
+	remove, err = s.releaseContents(tx, info)
+	if err != nil {
+		s.Logger.Printf("File release failure (%v): %v\n", fileUUID, err)
+		return FileInfo{}, false, err
 	}
+	return info, remove, nil
+}
 
-	if err := os.Remove(fileLocation); err != nil {
-		// TODO: Recover DB entry?
-		s.Logger.Printf("File remove failure (%v): %v\n", fileUUID, err)
+// removeStored removes thumbnails of removed file and its contents if
+// remove is true. It is called after DB entry removal is committed.
+func (s *Server) removeStored(info FileInfo, remove bool) error {
+	if err := s.removeThumbnails(info.UUID); err != nil {
+		s.Logger.Printf("Thumbnails remove failure (%v): %v\n", info.UUID, err)
+	}
+	if !remove {
+		return nil
+	}
+	if err := s.removeContents(info); err != nil {
+		s.Logger.Printf("File remove failure (%v): %v\n", info.UUID, err)
 		return errors.Wrap(err, "file remove")
 	}
 	return nil
@@ -146,14 +526,19 @@ func (s *Server) removeFile(tx *sql.Tx, fileUUID string) error {
 // OpenFile opens file for reading without any other side-effects
 // applied (such as "link" usage counting).
 func (s *Server) OpenFile(fileUUID string) (io.ReadSeeker, error) {
-	// Just to check validity.
-	_, err := uuid.FromString(fileUUID)
+	if !validFileID(fileUUID) {
+		return nil, errors.New("invalid file ID: " + fileUUID)
+	}
+
+	info, err := s.DB.FileInfo(nil, fileUUID)
 	if err != nil {
-		return nil, errors.Wrap(err, "uuid parse")
+		if err == sql.ErrNoRows {
+			return nil, ErrFileDoesntExists
+		}
+		return nil, errors.Wrap(err, "db query")
 	}
 
-	fileLocation := filepath.Join(s.Conf.StorageDir, fileUUID)
-	file, err := os.Open(fileLocation)
+	file, err := s.openContents(info)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Clean up the DB entry if the file was removed by an external program.
@@ -173,15 +558,27 @@ func (s *Server) OpenFile(fileUUID string) (io.ReadSeeker, error) {
 // through HTTP API, so it will count against usage count, for example.
 // To avoid this use OpenFile(fileUUID).
 func (s *Server) GetFile(fileUUID string) (r io.ReadSeeker, contentType string, err error) {
-	// Just to check validity.
-	_, err = uuid.FromString(fileUUID)
+	file, info, err := s.getFile(fileUUID, true)
 	if err != nil {
-		return nil, "", ErrFileDoesntExists
+		return nil, "", err
+	}
+	if info.compression != "" {
+		return newDecompressingReader(file, info.compression, info.Size), info.ContentType, nil
+	}
+	return file, info.ContentType, nil
+}
+
+// getFile opens file and counts its use if countUse is true. Returned
+// reader reads stored representation which is compressed if
+// info.compression is set.
+func (s *Server) getFile(fileUUID string, countUse bool) (readSeekCloser, FileInfo, error) {
+	if !validFileID(fileUUID) {
+		return nil, FileInfo{}, ErrFileDoesntExists
 	}
 
 	tx, err := s.DB.Begin()
 	if err != nil {
-		return nil, "", errors.Wrap(err, "tx begin")
+		return nil, FileInfo{}, errors.Wrap(err, "tx begin")
 	}
 	defer tx.Rollback() // rollback is no-op after commit
 
@@ -189,44 +586,112 @@ func (s *Server) GetFile(fileUUID string) (r io.ReadSeeker, contentType string,
 
 	if s.DB.ShouldDelete(tx, fileUUID) {
 		s.dbgLog("File removed just before getting, UUID:", fileUUID)
-		if err := s.removeFile(tx, fileUUID); err != nil {
+		info, infoErr := s.DB.FileInfo(tx, fileUUID)
+		removed, remove, err := s.removeFileTx(tx, fileUUID)
+		if err != nil {
 			s.Logger.Println("Error while trying to remove file", fileUUID+":", err)
 		}
 		if err := tx.Commit(); err != nil {
-			return nil, "", err
+			return nil, FileInfo{}, err
+		}
+		if err == nil {
+			s.removeStored(removed, remove)
 		}
-		return nil, "", ErrFileDoesntExists
+		if infoErr == nil {
+			s.fileRemoved(info, isExpired(info, time.Now()))
+		}
+		return nil, FileInfo{}, ErrFileDoesntExists
 	}
-	if err := s.DB.AddUse(tx, fileUUID); err != nil {
-		return nil, "", errors.Wrap(err, "add use")
+	if countUse {
+		if err := s.DB.AddUse(tx, fileUUID); err != nil {
+			return nil, FileInfo{}, errors.Wrap(err, "add use")
+		}
+	}
+	info, err := s.DB.FileInfo(tx, fileUUID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, FileInfo{}, ErrFileDoesntExists
+		}
+		return nil, FileInfo{}, errors.Wrap(err, "file info query")
 	}
 
-	fileLocation := filepath.Join(s.Conf.StorageDir, fileUUID)
-	r, err = os.Open(fileLocation)
+	file, size, err := s.openStored(info)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, "", ErrFileDoesntExists
+			return nil, FileInfo{}, ErrFileDoesntExists
 		}
 		// Clean up the DB entry if the file was removed by an external program.
 		if err := s.DB.RemoveFile(tx, fileUUID); err != nil {
 			s.Logger.Printf("DB remove failure (%v): %v\n", fileUUID, err)
 		}
-		return nil, "", err
+		return nil, FileInfo{}, err
+	}
+	// Size of compressed file is not recorded, but corruption will be
+	// detected by decompressor.
+	if info.Size >= 0 && info.compression == "" && size != info.Size {
+		file.Close()
+		s.Logger.Printf("File size mismatch (%v): %d bytes in DB, %d bytes on disk\n", fileUUID, info.Size, size)
+		return nil, FileInfo{}, ErrFileCorrupted
 	}
 	if err := tx.Commit(); err != nil {
-		return nil, "", errors.Wrap(err, "tx commit")
+		file.Close()
+		return nil, FileInfo{}, errors.Wrap(err, "tx commit")
+	}
+
+	if countUse {
+		s.useCounted(info)
 	}
 
-	ttype, err := s.DB.ContentType(nil, fileUUID)
+	return file, info, nil
+}
+
+// countUse counts use of already opened file.
+func (s *Server) countUse(fileUUID string) error {
+	tx, err := s.DB.Begin()
 	if err != nil {
-		return nil, "", errors.Wrap(err, "content type query")
+		return errors.Wrap(err, "tx begin")
+	}
+	defer tx.Rollback() // rollback is no-op after commit
+
+	if err := s.DB.AddUse(tx, fileUUID); err != nil {
+		return errors.Wrap(err, "add use")
+	}
+	info, err := s.DB.FileInfo(tx, fileUUID)
+	if err != nil {
+		return errors.Wrap(err, "file info query")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "tx commit")
 	}
 
-	return r, ttype, nil
+	s.useCounted(info)
+	return nil
+}
+
+func (s *Server) useCounted(info FileInfo) {
+	s.publish(EventDownloaded, info)
+	if info.MaxUses != 0 && info.Uses == info.MaxUses {
+		s.publish(EventExhausted, info)
+	}
+}
+
+func isExpired(info FileInfo, now time.Time) bool {
+	return !info.StoreUntil.IsZero() && info.StoreUntil.Before(now)
+}
+
+// fileRemoved publishes events and calls hooks for removed file.
+func (s *Server) fileRemoved(info FileInfo, expired bool) {
+	if expired {
+		s.publish(EventExpired, info)
+	}
+	s.publish(EventDeleted, info)
+	for _, h := range s.hooks.onRemove {
+		h.OnRemove(info)
+	}
 }
 
 func (s *Server) acceptFile(w http.ResponseWriter, r *http.Request) {
-	if s.Conf.UploadAuth.Callback != nil && !s.Conf.UploadAuth.Callback(r) {
+	if !s.Conf.UploadAuth.Allowed(r) {
 		s.Logger.Printf("Authentication failure (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
 		s.writeErr(w, r, http.StatusForbidden, "forbidden")
 		return
@@ -238,11 +703,26 @@ func (s *Server) acceptFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	query := r.URL.Query()
+	var body io.Reader = r.Body
+	contentType := r.Header.Get("Content-Type")
+	pasteForm := s.Conf.Paste.Enabled && isPasteForm(r)
+	if pasteForm {
+		text, err := parsePasteForm(r, query)
+		if err != nil {
+			s.Logger.Printf("Invalid paste form (URL %v, IP %v): %v", r.URL.String(), r.RemoteAddr, err)
+			s.writeErr(w, r, http.StatusBadRequest, "invalid paste form")
+			return
+		}
+		body = strings.NewReader(text)
+		contentType = "text/plain; charset=utf-8"
+	}
+
 	storeUntil := time.Time{}
-	if r.URL.Query().Get("store-secs") == "" && s.Conf.Limits.MaxStoreSecs != 0 {
+	if query.Get("store-secs") == "" && s.Conf.Limits.MaxStoreSecs != 0 {
 		storeUntil = time.Now().Add(time.Duration(s.Conf.Limits.MaxStoreSecs) * time.Second)
-	} else if r.URL.Query().Get("store-secs") != "" {
-		secs, err := strconv.Atoi(r.URL.Query().Get("store-secs"))
+	} else if query.Get("store-secs") != "" {
+		secs, err := strconv.Atoi(query.Get("store-secs"))
 		if err != nil {
 			s.Logger.Printf("Invalid store-secs (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
 			s.writeErr(w, r, http.StatusBadRequest, "invalid store-secs value")
@@ -256,51 +736,148 @@ func (s *Server) acceptFile(w http.ResponseWriter, r *http.Request) {
 		storeUntil = time.Now().Add(time.Duration(secs) * time.Second)
 	}
 	var maxUses uint
-	if r.URL.Query().Get("max-uses") == "" && s.Conf.Limits.MaxUses != 0 {
+	if query.Get("max-uses") == "" && s.Conf.Limits.MaxUses != 0 {
 		maxUses = s.Conf.Limits.MaxUses
-	} else if r.URL.Query().Get("max-uses") != "" {
-		var err error
-		maxUses, err := strconv.Atoi(r.URL.Query().Get("max-uses"))
+	} else if query.Get("max-uses") != "" {
+		parsed, err := strconv.ParseUint(query.Get("max-uses"), 10, 32)
 		if err != nil {
-			s.Logger.Printf("Invalid max-uses store-secs (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
+			s.Logger.Printf("Invalid max-uses (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
 			s.writeErr(w, r, http.StatusBadRequest, "invalid max-uses value")
 			return
 		}
-		if s.Conf.Limits.MaxUses != 0 && uint(maxUses) > s.Conf.Limits.MaxUses {
-			s.Logger.Printf("Too big max-uses store-secs (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
+		maxUses = uint(parsed)
+		if s.Conf.Limits.MaxUses != 0 && maxUses > s.Conf.Limits.MaxUses {
+			s.Logger.Printf("Too big max-uses (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
 			s.writeErr(w, r, http.StatusBadRequest, "too big max-uses value")
 			return
 		}
 	}
 
-	fileUUID, err := s.AddFile(r.Body, r.Header.Get("Content-Type"), maxUses, storeUntil)
+	encryption := query.Get("encryption")
+	if encryption != "" && encryption != EncryptionE2E {
+		s.Logger.Printf("Invalid encryption (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
+		s.writeErr(w, r, http.StatusBadRequest, "invalid encryption value")
+		return
+	}
+
+	strip := s.Conf.StripMetadata
+	if query.Get("strip-metadata") != "" {
+		var err error
+		strip, err = strconv.ParseBool(query.Get("strip-metadata"))
+		if err != nil {
+			s.Logger.Printf("Invalid strip-metadata (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
+			s.writeErr(w, r, http.StatusBadRequest, "invalid strip-metadata value")
+			return
+		}
+	}
+
+	slug := query.Get("slug")
+	if slug != "" && !s.Conf.IDs.Slugs {
+		s.Logger.Printf("Slugs are disabled (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
+		s.writeErr(w, r, http.StatusBadRequest, "slugs are not allowed")
+		return
+	}
+	if slug != "" && !validSlug(slug, s.reservedNames()) {
+		s.Logger.Printf("Invalid slug (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
+		s.writeErr(w, r, http.StatusBadRequest, "invalid slug value")
+		return
+	}
+
+	// Files encrypted by client are opaque.
+	if encryption == "" {
+		head := make([]byte, sniffLen)
+		n, err := io.ReadFull(body, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			s.Logger.Printf("I/O error (URL %v, IP %v): %v", r.URL.String(), r.RemoteAddr, err)
+			s.writeErr(w, r, http.StatusBadRequest, "body read failure")
+			return
+		}
+		body = io.MultiReader(bytes.NewReader(head[:n]), body)
+		contentType = s.Conf.ContentTypes.sniffContentType(contentType, head[:n])
+	}
+	if !s.Conf.ContentTypes.allowed(contentType) {
+		s.Logger.Printf("Content type is not allowed (URL %v, IP %v): %v", r.URL.String(), r.RemoteAddr, contentType)
+		s.writeErr(w, r, http.StatusUnsupportedMediaType, "content type is not allowed")
+		return
+	}
+
+	passwordHash := ""
+	if password := uploadPassword(r); password != "" {
+		var err error
+		passwordHash, err = hashPassword(password)
+		if err != nil {
+			s.Logger.Printf("Invalid password (URL %v, IP %v): %v", r.URL.String(), r.RemoteAddr, err)
+			s.writeErr(w, r, http.StatusBadRequest, "invalid password")
+			return
+		}
+	}
+
+	params := UploadParams{
+		ContentType:   contentType,
+		MaxUses:       maxUses,
+		StoreUntil:    storeUntil,
+		StripMetadata: strip,
+	}
+	for _, h := range s.hooks.beforeUpload {
+		if err := h.BeforeUpload(r, &params); err != nil {
+			s.Logger.Printf("Upload rejected by hook (URL %v, IP %v): %v", r.URL.String(), r.RemoteAddr, err)
+			s.writeRejection(w, r, err)
+			return
+		}
+	}
+
+	info, err := s.addFile(body, FileInfo{
+		UUID:        slug,
+		ContentType: params.ContentType,
+		MaxUses:     params.MaxUses,
+		StoreUntil:  params.StoreUntil,
+		Encryption:  encryption,
+
+		passwordHash: passwordHash,
+	}, params.StripMetadata)
 	if err != nil {
+		if errors.Cause(err) == errMalformedImage {
+			s.Logger.Printf("Malformed image (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
+			s.writeErr(w, r, http.StatusBadRequest, "malformed image")
+			return
+		}
+		if err == ErrIDTaken {
+			s.Logger.Printf("Slug is taken (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
+			s.writeErr(w, r, http.StatusConflict, "slug is already taken")
+			return
+		}
 		s.Logger.Println("Error while serving", r.RequestURI+":", err)
 		s.writeErr(w, r, http.StatusInternalServerError, "internal server error")
 		return
 	}
 
-	s.dbgLog("Accepted file, assigned UUID is", fileUUID)
-
-	// Smart logic to convert request's URL into absolute result URL.
-	resURL := url.URL{}
-	if r.Header.Get("X-HTTPS-Downstream") == "1" {
-		resURL.Scheme = "https"
-	} else if r.Header.Get("X-HTTPS-Downstream") == "0" {
-		resURL.Scheme = "http"
-	} else if s.Conf.HTTPSDownstream {
-		resURL.Scheme = "https"
-	} else {
-		resURL.Scheme = "http"
-	}
-	resURL.Host = r.Host
-	splittenPath := strings.Split(r.URL.Path, "/")
-	if r.URL.Path == "/" {
-		splittenPath = nil
+	fileUUID := info.UUID
+	for _, h := range s.hooks.afterUpload {
+		h.AfterUpload(r, info)
 	}
+
+	s.dbgLog("Accepted file, assigned ID is", fileUUID)
+
+	resURL, basePath := s.linkBase(r)
+	splittenPath := strings.Split(strings.TrimSuffix(basePath, "/"), "/")
 	splittenPath = append(splittenPath, fileUUID)
+	if s.Conf.Paste.Enabled {
+		// Used by paste page to select highlighting.
+		if name := query.Get("name"); name != "" {
+			splittenPath = append(splittenPath, strings.Replace(name, "/", "_", -1))
+		}
+		if lang := query.Get("lang"); lang != "" {
+			resURL.RawQuery = url.Values{"lang": {lang}}.Encode()
+		}
+	}
 	resURL.Path = strings.Join(splittenPath, "/")
 
+	if pasteForm && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		// Browser submitted form, show paste.
+		http.Redirect(w, r, resURL.String(), http.StatusSeeOther)
+		return
+	}
+
 	w.Header().Add("Content-Type", `text/plain; charset="us-ascii"`)
 	w.WriteHeader(http.StatusCreated)
 	if _, err := w.Write([]byte(resURL.String())); err != nil {
@@ -308,6 +885,30 @@ func (s *Server) acceptFile(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// linkBase returns URL (without path) and base path of links to files
+// uploaded by request.
+func (s *Server) linkBase(r *http.Request) (resURL url.URL, basePath string) {
+	// Smart logic to convert request's URL into absolute result URL.
+	basePath = r.URL.Path
+	if s.downloadURL != nil {
+		// Files are served only from download host.
+		resURL.Scheme = s.downloadURL.Scheme
+		resURL.Host = s.downloadURL.Host
+		basePath = s.downloadURL.Path
+	} else {
+		var prefix string
+		resURL.Scheme, resURL.Host, prefix = s.requestOrigin(r)
+		if s.Conf.IDs.Slugs {
+			// Upload path may be a slug, so links don't include it
+			// and ID is at fixed position (see resolveFilePath).
+			basePath = prefix
+		} else {
+			basePath = prefix + basePath
+		}
+	}
+	return resURL, basePath
+}
+
 func (s *Server) writeErr(w http.ResponseWriter, r *http.Request, code int, replyText string) {
 	w.Header().Add("Content-Type", `text/plain; charset="us-ascii"`)
 	w.WriteHeader(code)
@@ -318,27 +919,99 @@ func (s *Server) writeErr(w http.ResponseWriter, r *http.Request, code int, repl
 }
 
 func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
-	if s.Conf.DownloadAuth.Callback != nil && !s.Conf.DownloadAuth.Callback(r) {
+	if !s.Conf.DownloadAuth.Allowed(r) {
 		s.Logger.Printf("Authentication failure (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
 		s.writeErr(w, r, http.StatusForbidden, "forbidden")
 		return
 	}
 
-	splittenPath := strings.Split(r.URL.Path, "/")
-	if len(splittenPath) < 2 {
-		s.writeErr(w, r, http.StatusNotFound, "not found")
+	info, fileName, err := s.resolveFilePath(r.URL.Path)
+	fileUUID := info.UUID
+	if err != nil {
+		if err == ErrFileDoesntExists {
+			s.writeErr(w, r, http.StatusNotFound, "not found")
+		} else {
+			s.Logger.Println("Error while serving", r.RequestURI+":", err)
+			s.writeErr(w, r, http.StatusInternalServerError, "internal server error")
+		}
 		return
 	}
-	fileUUID := splittenPath[len(splittenPath)-1]
-	if _, err := uuid.FromString(fileUUID); err != nil {
-		// Probably last component is fake "filename".
-		if len(splittenPath) == 1 {
-			s.writeErr(w, r, http.StatusNotFound, "not found")
+	if isE2EPageRequest(r, info) {
+		s.serveE2EDownloadPage(w, r)
+		return
+	}
+	// Checked before use is counted, so failed attempts are not counted.
+	if !s.checkPassword(w, r, info) {
+		return
+	}
+
+	width, thumbnail, err := s.thumbnailWidth(r)
+	if thumbnail {
+		if err != nil {
+			s.writeErr(w, r, http.StatusBadRequest, "invalid thumbnail width")
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			s.writeErr(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+	}
+
+	// Probes of file type by preview crawlers get contents and are never
+	// counted.
+	probe := s.isRangeProbe(r, info.Size)
+	if r.Method == http.MethodGet && s.isPreviewBot(r) && !thumbnail && !probe && !isUsedUp(info, time.Now()) {
+		s.servePreviewStub(w, r, info, fileName)
+		return
+	}
+	pasteView := s.isPasteView(r, info)
+	if s.downloadPage != nil || s.pastePage != nil {
+		w.Header().Add("Vary", "Accept")
+	}
+	// Not shown for used up files, so it is removed as usual.
+	if s.downloadPage != nil && !pasteView && !thumbnail && isBrowserNavigation(r) && !isUsedUp(info, time.Now()) {
+		s.serveLandingPage(w, r, info, fileName)
+		return
+	}
+
+	for _, h := range s.hooks.beforeDownload {
+		if err := h.BeforeDownload(r, info); err != nil {
+			s.Logger.Printf("Download rejected by hook (URL %v, IP %v): %v", r.URL.String(), r.RemoteAddr, err)
+			s.writeRejection(w, r, err)
 			return
 		}
-		fileUUID = splittenPath[len(splittenPath)-2]
 	}
-	reader, ttype, err := s.GetFile(fileUUID)
+
+	if thumbnail {
+		s.serveThumbnail(w, r, info, width)
+		return
+	}
+
+	// Checked before use is counted, so revalidation of cached copy is
+	// never counted.
+	encoded := info.compression != "" && !pasteView && acceptsEncoding(r.Header.Get("Accept-Encoding"), info.compression)
+	if !pasteView && !isUsedUp(info, time.Now()) && notModified(r, fileETag(info, encoded), info.CreatedAt) {
+		s.setFileHeaders(w, info, fileName, encoded)
+		writeNotModified(w)
+		return
+	}
+
+	offload := s.canOffload(info) && r.Method != http.MethodOptions && !pasteView
+	countNow := false
+	if r.Method == http.MethodGet && !probe {
+		switch s.Conf.Limits.UsePolicy {
+		case UsePolicyRequest:
+			countNow = true
+		case UsePolicySession:
+			countNow = s.downloads.begin(s.sessionKey(r, fileUUID), time.Now())
+		case UsePolicyDelivered:
+			// Delivery can't be tracked if contents is sent by proxy,
+			// paste page is delivered as a whole.
+			countNow = offload || pasteView
+		}
+	}
+
+	file, info, err := s.getFile(fileUUID, countNow)
 	if err != nil {
 		if err == ErrFileDoesntExists {
 			s.writeErr(w, r, http.StatusNotFound, "not found")
@@ -348,15 +1021,47 @@ func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	if ttype != "" {
-		w.Header().Set("Content-Type", ttype)
+	defer file.Close()
+
+	var reader io.ReadSeeker = file
+	if info.compression != "" && !encoded {
+		reader = newDecompressingReader(file, info.compression, info.Size)
+	}
+	if !pasteView {
+		// Paste page is not a file representation.
+		s.setFileHeaders(w, info, fileName, encoded)
 	}
-	w.Header().Set("ETag", fileUUID)
-	w.Header().Set("Cache-Control", "public, immutable, max-age=31536000")
 	if r.Method == http.MethodOptions {
 		reader = bytes.NewReader([]byte{})
 	}
-	http.ServeContent(w, r, fileUUID, time.Time{}, reader)
+	if pasteView {
+		s.servePaste(w, r, info, fileName, reader)
+	} else if offload {
+		if err := s.writeOffload(w, info); err != nil {
+			s.Logger.Println("Error while serving", r.RequestURI+":", err)
+			s.writeErr(w, r, http.StatusInternalServerError, "internal server error")
+			return
+		}
+	} else if r.Method == http.MethodGet && !probe && s.Conf.Limits.UsePolicy == UsePolicyDelivered {
+		size, err := reader.Seek(0, io.SeekEnd)
+		if err == nil {
+			_, err = reader.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			s.Logger.Println("Error while serving", r.RequestURI+":", err)
+			s.writeErr(w, r, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		dw := s.trackDelivery(w, r, fileUUID, size)
+		http.ServeContent(dw, r, fileUUID, info.CreatedAt, reader)
+		dw.finish()
+	} else {
+		http.ServeContent(w, r, fileUUID, info.CreatedAt, reader)
+	}
+
+	for _, h := range s.hooks.afterDownload {
+		h.AfterDownload(r, info)
+	}
 }
 
 // ServeHTTP implements http.Handler for filedrop.Server.
@@ -364,16 +1069,57 @@ func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
 // Note that filedrop code is URL prefix-agnostic, so request URI doesn't
 // matters much.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Pages replace CSP with their own.
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", fileCSP)
+
+	if s.rejectQueryPassword(w, r) {
+		return
+	}
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		if s.Conf.Health.LivenessPath != "" && r.URL.Path == s.Conf.Health.LivenessPath {
+			s.serveHealth(w, r, s.Liveness())
+			return
+		}
+		if s.Conf.Health.ReadinessPath != "" && r.URL.Path == s.Conf.Health.ReadinessPath {
+			s.serveHealth(w, r, s.Readiness())
+			return
+		}
+		if s.Conf.E2EPagePath != "" && r.URL.Path == s.Conf.E2EPagePath && !s.isDownloadHost(r) {
+			s.serveE2EUploadPage(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, assetsPrefix) && (s.uploadPage != nil || s.downloadPage != nil || s.pastePage != nil) {
+			s.serveWebAsset(w, r, strings.TrimPrefix(r.URL.Path, assetsPrefix))
+			return
+		}
+		if s.uploadPage != nil && s.isUploadPageRequest(r) && !s.isDownloadHost(r) {
+			s.serveUploadPage(w, r)
+			return
+		}
+	}
+
 	w.Header().Set("Access-Control-Allow-Origin", s.Conf.AllowedOrigins)
 	if r.Method == http.MethodPost {
+		if s.isDownloadHost(r) {
+			s.Logger.Printf("Upload to download host (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
+			s.writeErr(w, r, http.StatusForbidden, "uploads are not accepted on download host")
+			return
+		}
 		s.acceptFile(w, r)
 	} else if r.Method == http.MethodGet ||
 		r.Method == http.MethodHead {
 
+		if s.downloadURL != nil && !s.isDownloadHost(r) {
+			s.Logger.Printf("Download from upload host (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
+			s.writeErr(w, r, http.StatusForbidden, "files are served only from download host")
+			return
+		}
 		s.serveFile(w, r)
 	} else if r.Method == http.MethodOptions {
 		w.Header().Set("Access-Control-Allow-Methods", "HEAD, GET, POST, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Authorization, "+passwordHeader)
 		w.WriteHeader(http.StatusNoContent)
 	} else {
 		s.writeErr(w, r, http.StatusMethodNotAllowed, "method not allowed")
@@ -385,13 +1131,18 @@ func (s *Server) Close() error {
 	s.fileCleanerStopChan <- true
 	<-s.fileCleanerStopChan
 
+	for _, sink := range s.eventSinks {
+		if closer, ok := sink.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				s.Logger.Println("Failed to close event sink:", err)
+			}
+		}
+	}
+
 	return s.DB.Close()
 }
 
 func (s *Server) fileCleaner() {
-	if s.Conf.CleanupIntervalSecs == 0 {
-		s.Conf.CleanupIntervalSecs = 60
-	}
 	tick := time.NewTicker(time.Duration(s.Conf.CleanupIntervalSecs) * time.Second)
 	for {
 		select {
@@ -400,6 +1151,8 @@ func (s *Server) fileCleaner() {
 			return
 		case <-tick.C:
 			s.cleanupFiles()
+			s.downloads.prune(time.Now())
+			s.cleanerHeartbeat.Store(time.Now())
 		}
 	}
 }
@@ -424,10 +1177,21 @@ func (s *Server) cleanupFiles() {
 		s.dbgLog(len(uuids), "file to be removed")
 	}
 
+	infos := make([]FileInfo, 0, len(uuids))
+	remove := make([]bool, 0, len(uuids))
 	for _, fileUUID := range uuids {
-		if err := os.Remove(filepath.Join(s.Conf.StorageDir, fileUUID)); err != nil {
-			s.Logger.Println("Failed to remove file during clean-up:", err)
+		info, err := s.DB.FileInfo(tx, fileUUID)
+		if err != nil {
+			s.Logger.Println("Failed to get file info during clean-up:", err)
+			info = FileInfo{UUID: fileUUID, Size: -1}
+		}
+		infos = append(infos, info)
+
+		released, err := s.releaseContents(tx, info)
+		if err != nil {
+			s.Logger.Println("Failed to release file during clean-up:", err)
 		}
+		remove = append(remove, released)
 	}
 
 	if err := s.DB.RemoveStaleFiles(tx, now); err != nil {
@@ -436,6 +1200,13 @@ func (s *Server) cleanupFiles() {
 	}
 
 	if err := tx.Commit(); err != nil {
-		s.Logger.Println("Failed to begin transaction for clean-up:", err)
+		s.Logger.Println("Failed to commit transaction for clean-up:", err)
+		return
+	}
+
+	for i, info := range infos {
+		// Errors are logged by removeStored.
+		s.removeStored(info, remove[i])
+		s.fileRemoved(info, isExpired(info, now))
 	}
 }
@@ -0,0 +1,240 @@
+package filedrop
+
+import (
+	"bytes"
+	"database/sql"
+	"image"
+	_ "image/gif" // registers decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/image/draw"
+)
+
+// thumbnailParam is a query parameter specifying thumbnail width.
+const thumbnailParam = "w"
+
+var defaultThumbnailWidths = []int{160, 320, 640, 1280}
+
+// errNoThumbnail is returned if image can't be decoded or is too large.
+var errNoThumbnail = errors.New("thumbnail is not available")
+
+func (s *Server) thumbnailsDir() string {
+	return filepath.Join(s.Conf.StorageDir, "thumbnails")
+}
+
+// thumbnailPath returns location of cached thumbnail on disk. Thumbnails
+// of each file are stored in a separate directory so they can be removed
+// together.
+func (s *Server) thumbnailPath(fileUUID string, width int) string {
+	return filepath.Join(s.thumbnailsDir(), fileUUID, strconv.Itoa(width))
+}
+
+// removeThumbnails removes all cached thumbnails of file, it is no-op if
+// there are none.
+func (s *Server) removeThumbnails(fileUUID string) error {
+	return os.RemoveAll(filepath.Join(s.thumbnailsDir(), fileUUID))
+}
+
+// thumbnailType returns content type of thumbnail generated for image
+// with specified content type or empty string if thumbnail can't be
+// generated.
+func thumbnailType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	switch mediaType {
+	case "image/jpeg":
+		return "image/jpeg"
+	case "image/png", "image/gif":
+		// Only first frame of GIF is used, so there is no point in keeping it.
+		return "image/png"
+	}
+	return ""
+}
+
+// thumbnailWidth returns requested thumbnail width, ok is false if
+// thumbnail is not requested.
+func (s *Server) thumbnailWidth(r *http.Request) (width int, ok bool, err error) {
+	if !s.Conf.Thumbnails.Enabled {
+		return 0, false, nil
+	}
+	param := r.URL.Query().Get(thumbnailParam)
+	if param == "" {
+		return 0, false, nil
+	}
+	width, err = strconv.Atoi(param)
+	if err != nil {
+		return 0, true, errors.Wrap(err, "width parse")
+	}
+	for _, allowed := range s.Conf.Thumbnails.Widths {
+		if width == allowed {
+			return width, true, nil
+		}
+	}
+	return 0, true, errors.New("width is not allowed")
+}
+
+// makeThumbnail decodes image and writes its copy scaled down to width
+// (preserving aspect ratio) to out. Images narrower than width are not
+// scaled.
+func makeThumbnail(out io.Writer, in io.ReadSeeker, contentType string, width, maxPixels int) error {
+	config, _, err := image.DecodeConfig(in)
+	if err != nil {
+		return errNoThumbnail
+	}
+	// Checked before decoding so decompression bombs are not unpacked.
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxPixels {
+		return errNoThumbnail
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	src, _, err := image.Decode(in)
+	if err != nil {
+		return errNoThumbnail
+	}
+
+	bounds := src.Bounds()
+	if width > bounds.Dx() {
+		width = bounds.Dx()
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height == 0 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+	if thumbnailType(contentType) == "image/jpeg" {
+		return jpeg.Encode(out, dst, &jpeg.Options{Quality: 85})
+	}
+	return png.Encode(out, dst)
+}
+
+// writeThumbnail generates thumbnail of stored file.
+func (s *Server) writeThumbnail(out io.Writer, fileUUID string, width int) error {
+	file, info, err := s.getFile(fileUUID, false)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var reader io.ReadSeeker = file
+	if info.compression != "" {
+		reader = newDecompressingReader(file, info.compression, info.Size)
+	}
+	return makeThumbnail(out, reader, info.ContentType, width, s.Conf.Thumbnails.MaxPixels)
+}
+
+// openThumbnail opens cached thumbnail, generating it if needed.
+func (s *Server) openThumbnail(fileUUID string, width int) (*os.File, error) {
+	thumbPath := s.thumbnailPath(fileUUID, width)
+	thumb, err := os.Open(thumbPath)
+	if err == nil {
+		return thumb, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Written to temporary file first so concurrent requests never see
+	// partially written thumbnail. Directory of file is created only after
+	// thumbnail is generated, so it is not left for removed files.
+	temp, err := ioutil.TempFile(s.thumbnailsDir(), "thumb-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(temp.Name()) // no-op if renamed
+	defer temp.Close()
+	if err := s.writeThumbnail(temp, fileUUID, width); err != nil {
+		return nil, err
+	}
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(thumbPath), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(temp.Name(), thumbPath); err != nil {
+		return nil, err
+	}
+
+	// File could be removed while thumbnail was generated, its thumbnails
+	// are removed after commit so directory created above is either
+	// removed there or here.
+	err = retryQuery(func() error {
+		_, err := s.DB.FileInfo(nil, fileUUID)
+		return err
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			if err := s.removeThumbnails(fileUUID); err != nil {
+				return nil, err
+			}
+			return nil, ErrFileDoesntExists
+		}
+		return nil, errors.Wrap(err, "db query")
+	}
+	return os.Open(thumbPath)
+}
+
+// serveThumbnail serves scaled down copy of image. It is not counted as
+// a use of file, so files with max uses set don't get thumbnails.
+func (s *Server) serveThumbnail(w http.ResponseWriter, r *http.Request, info FileInfo, width int) {
+	contentType := thumbnailType(info.ContentType)
+	// Server can't decode files encrypted by client. Thumbnails of files
+	// with limited uses would be unlimited copies of them.
+	if contentType == "" || info.Encryption != "" || info.MaxUses != 0 {
+		s.writeErr(w, r, http.StatusBadRequest, "thumbnail is not available")
+		return
+	}
+	now := time.Now()
+	if isUsedUp(info, now) {
+		s.writeErr(w, r, http.StatusNotFound, "not found")
+		return
+	}
+
+	var thumb io.ReadSeeker
+	var err error
+	if info.dataKey != "" {
+		// Not cached, so contents of encrypted file is never stored in
+		// plaintext.
+		var buf bytes.Buffer
+		err = s.writeThumbnail(&buf, info.UUID, width)
+		thumb = bytes.NewReader(buf.Bytes())
+	} else {
+		var file *os.File
+		file, err = s.openThumbnail(info.UUID, width)
+		if err == nil {
+			defer file.Close()
+		}
+		thumb = file
+	}
+	if err != nil {
+		switch err {
+		case ErrFileDoesntExists:
+			s.writeErr(w, r, http.StatusNotFound, "not found")
+		case errNoThumbnail:
+			s.writeErr(w, r, http.StatusBadRequest, "thumbnail is not available")
+		default:
+			s.Logger.Println("Error while serving", r.RequestURI+":", err)
+			s.writeErr(w, r, http.StatusInternalServerError, "internal server error")
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", s.cacheControl(info, now))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, info.UUID, info.CreatedAt, thumb)
+}
@@ -0,0 +1,213 @@
+package filedrop_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/filedrop"
+)
+
+func testImage(t *testing.T, format string) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	for x := 0; x < 100; x++ {
+		for y := 0; y < 50; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 2), uint8(y * 5), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	var err error
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, nil)
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func thumbnailsConf() filedrop.Config {
+	conf := filedrop.Default
+	conf.Thumbnails.Enabled = true
+	conf.Thumbnails.Widths = []int{40, 320}
+	return conf
+}
+
+func getThumbnail(t *testing.T, c *http.Client, url, contentType string) image.Image {
+	t.Helper()
+
+	resp, body := getWithHeader(t, c, url, "Accept", "image/*")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("GET: HTTP", resp.StatusCode, resp.Status)
+	}
+	if resp.Header.Get("Content-Type") != contentType {
+		t.Fatal("Wrong Content-Type:", resp.Header.Get("Content-Type"))
+	}
+	img, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func thumbnailsDir(serv *filedrop.Server, fileUUID string) string {
+	return filepath.Join(serv.Conf.StorageDir, "thumbnails", fileUUID)
+}
+
+func TestThumbnail(t *testing.T) {
+	serv := initServ(thumbnailsConf())
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop/screenshot.png", "image/png", bytes.NewReader(testImage(t, "png"))))
+	fileUUID := url[strings.LastIndex(url, "/")+1:]
+
+	for i := 0; i < 2; i++ {
+		img := getThumbnail(t, c, url+"?w=40", "image/png")
+		if size := img.Bounds().Size(); size.X != 40 || size.Y != 20 {
+			t.Error("Wrong thumbnail size:", size)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(thumbnailsDir(serv, fileUUID), "40")); err != nil {
+		t.Error("Thumbnail is not cached:", err)
+	}
+	if uses := fileUses(t, serv, url); uses != 0 {
+		t.Error("Thumbnails counted as uses:", uses)
+	}
+
+	if err := serv.RemoveFile(fileUUID); err != nil {
+		t.Fatal(err)
+	}
+	if code := doGETFail(t, c, url+"?w=40"); code != http.StatusNotFound {
+		t.Error("GET: HTTP", code)
+	}
+	if _, err := os.Stat(thumbnailsDir(serv, fileUUID)); !os.IsNotExist(err) {
+		t.Error("Thumbnails are not removed with file:", err)
+	}
+}
+
+func TestThumbnailLimitedUses(t *testing.T) {
+	conf := thumbnailsConf()
+	conf.Limits.MaxUses = 1
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "image/png", bytes.NewReader(testImage(t, "png"))))
+	fileUUID := url[strings.LastIndex(url, "/")+1:]
+	for i := 0; i < 2; i++ {
+		if code := doGETFail(t, c, url+"?w=40"); code != http.StatusBadRequest {
+			t.Error("GET: HTTP", code)
+		}
+	}
+	if _, err := os.Stat(thumbnailsDir(serv, fileUUID)); !os.IsNotExist(err) {
+		t.Error("Thumbnail is generated:", err)
+	}
+	if body := doGET(t, c, url); !bytes.Equal(body, testImage(t, "png")) {
+		t.Error("Got different file!")
+	}
+}
+
+func TestThumbnailNoUpscale(t *testing.T) {
+	serv := initServ(thumbnailsConf())
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "image/jpeg", bytes.NewReader(testImage(t, "jpeg"))))
+	img := getThumbnail(t, c, url+"?w=320", "image/jpeg")
+	if size := img.Bounds().Size(); size.X != 100 || size.Y != 50 {
+		t.Error("Wrong thumbnail size:", size)
+	}
+}
+
+func TestThumbnailInvalid(t *testing.T) {
+	serv := initServ(thumbnailsConf())
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	imageURL := string(doPOST(t, c, ts.URL+"/filedrop", "image/png", bytes.NewReader(testImage(t, "png"))))
+	textURL := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	brokenURL := string(doPOST(t, c, ts.URL+"/filedrop", "image/png", strings.NewReader(file)))
+
+	cases := []string{
+		imageURL + "?w=41",
+		imageURL + "?w=meow",
+		textURL + "?w=40",
+		brokenURL + "?w=40",
+	}
+	for _, url := range cases {
+		if code := doGETFail(t, c, url); code != http.StatusBadRequest {
+			t.Error("GET", url, "HTTP", code)
+		}
+	}
+}
+
+func TestThumbnailHookRejected(t *testing.T) {
+	hook := &testHook{}
+	serv := initServ(thumbnailsConf())
+	serv.AddHook(hook)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "image/png", bytes.NewReader(testImage(t, "png"))))
+	fileUUID := url[strings.LastIndex(url, "/")+1:]
+
+	if code := doGETFail(t, c, url+"?w=40&reject=1"); code != http.StatusForbidden {
+		t.Error("GET: HTTP", code)
+	}
+	if _, err := os.Stat(thumbnailsDir(serv, fileUUID)); !os.IsNotExist(err) {
+		t.Error("Thumbnail is generated for rejected download:", err)
+	}
+	// Content type is rewritten by hook.
+	if code := doGETFail(t, c, url+"?w=40"); code != http.StatusBadRequest {
+		t.Error("GET: HTTP", code)
+	}
+	if calls := hook.Calls(); calls != "BeforeUpload,AfterUpload,BeforeDownload,BeforeDownload" {
+		t.Error("Wrong hook calls:", calls)
+	}
+}
+
+func TestThumbnailCleanup(t *testing.T) {
+	conf := thumbnailsConf()
+	conf.CleanupIntervalSecs = 1
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	fileUUID, err := serv.AddFile(bytes.NewReader(testImage(t, "png")), "image/png", 0, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	getThumbnail(t, c, ts.URL+"/filedrop/"+fileUUID+"?w=40", "image/png")
+
+	time.Sleep(3 * time.Second)
+
+	if _, err := os.Stat(thumbnailsDir(serv, fileUUID)); !os.IsNotExist(err) {
+		t.Error("Thumbnails are not removed during clean-up:", err)
+	}
+}
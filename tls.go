@@ -0,0 +1,153 @@
+package filedrop
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Enabled reports whether TLS should be used by listener.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// ServerConfig builds *tls.Config using configuration values.
+//
+// Certificate and key files are checked for modification at most once
+// per second and reloaded when changed, so there is no need to restart
+// server after certificate renewal.
+func (c TLSConfig) ServerConfig() (*tls.Config, error) {
+	loader := &certLoader{certFile: c.CertFile, keyFile: c.KeyFile}
+	if _, err := loader.load(); err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{
+		GetCertificate: loader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if c.DisableHTTP2 {
+		conf.NextProtos = []string{"http/1.1"}
+	}
+	if c.MinVersion != "" {
+		ver, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, errors.New("unknown TLS version: " + c.MinVersion)
+		}
+		conf.MinVersion = ver
+	}
+
+	if c.ClientCA != "" {
+		pemBlob, err := ioutil.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "client CA read")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemBlob) {
+			return nil, errors.New("no certificates found in client CA bundle")
+		}
+		conf.ClientCAs = pool
+		// Certificate is not required on TLS level, access checks are done
+		// by AuthConfig so uploads and downloads can have different policies.
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return conf, nil
+}
+
+type certLoader struct {
+	certFile, keyFile string
+
+	lock      sync.Mutex
+	cert      *tls.Certificate
+	certMtime time.Time
+	keyMtime  time.Time
+	lastCheck time.Time
+}
+
+func (l *certLoader) load() (*tls.Certificate, error) {
+	certStat, err := os.Stat(l.certFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "certificate stat")
+	}
+	keyStat, err := os.Stat(l.keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "key stat")
+	}
+
+	if l.cert != nil && certStat.ModTime().Equal(l.certMtime) && keyStat.ModTime().Equal(l.keyMtime) {
+		return l.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "key pair load")
+	}
+	l.cert = &cert
+	l.certMtime = certStat.ModTime()
+	l.keyMtime = keyStat.ModTime()
+	return l.cert, nil
+}
+
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if time.Since(l.lastCheck) < time.Second {
+		return l.cert, nil
+	}
+	l.lastCheck = time.Now()
+
+	cert, err := l.load()
+	if err != nil {
+		// Keep serving old certificate if new one is broken (or partially written).
+		if l.cert != nil {
+			return l.cert, nil
+		}
+		return nil, err
+	}
+	return cert, nil
+}
+
+// clientCertAllowed checks whether request is made using verified client
+// certificate with one of allowed names (if any).
+func clientCertAllowed(r *http.Request, allowedNames []string) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	if len(allowedNames) == 0 {
+		return true
+	}
+
+	leaf := r.TLS.VerifiedChains[0][0]
+	for _, name := range allowedNames {
+		if leaf.Subject.CommonName == name {
+			return true
+		}
+		for _, dnsName := range leaf.DNSNames {
+			if dnsName == name {
+				return true
+			}
+		}
+		for _, email := range leaf.EmailAddresses {
+			if email == name {
+				return true
+			}
+		}
+	}
+	return false
+}
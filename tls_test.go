@@ -0,0 +1,196 @@
+package filedrop_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/filedrop"
+)
+
+func genCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent = tmpl
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return cert, key, certPEM, keyPEM
+}
+
+func TestTLSClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filedrop-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey, caPEM, _ := genCert(t, "Test CA", nil, nil)
+	_, _, servPEM, servKeyPEM := genCert(t, "127.0.0.1", ca, caKey)
+	_, _, cliPEM, cliKeyPEM := genCert(t, "uploader", ca, caKey)
+	_, _, otherPEM, otherKeyPEM := genCert(t, "stranger", ca, caKey)
+
+	for name, blob := range map[string][]byte{"ca.pem": caPEM, "cert.pem": servPEM, "key.pem": servKeyPEM} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), blob, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf := filedrop.Default
+	conf.TLS = filedrop.TLSConfig{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+		ClientCA: filepath.Join(dir, "ca.pem"),
+	}
+	conf.UploadAuth.ClientCert = true
+	conf.UploadAuth.ClientNames = []string{"uploader"}
+	serv := initServ(conf)
+	defer cleanServ(serv)
+
+	tlsConf, err := conf.TLS.ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// httptest.Server.StartTLS replaces certificates with its own, so
+	// wrap listener manually.
+	ts := httptest.NewUnstartedServer(serv)
+	ts.Listener = tls.NewListener(ts.Listener, tlsConf)
+	ts.Start()
+	defer ts.Close()
+	tsURL := strings.Replace(ts.URL, "http://", "https://", 1)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	clientWith := func(certPEM, keyPEM []byte) *http.Client {
+		tlsConf := &tls.Config{RootCAs: pool}
+		if certPEM != nil {
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConf.Certificates = []tls.Certificate{cert}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}}
+	}
+
+	var url string
+	t.Run("upload with allowed certificate", func(t *testing.T) {
+		url = string(doPOST(t, clientWith(cliPEM, cliKeyPEM), tsURL+"/filedrop", "text/plain", strings.NewReader(file)))
+		if !strings.HasPrefix(url, "https://") {
+			t.Error("Got non-HTTPS URL over TLS:", url)
+		}
+	})
+	t.Run("upload with other certificate (fail)", func(t *testing.T) {
+		if code := doPOSTFail(t, clientWith(otherPEM, otherKeyPEM), tsURL+"/filedrop", "text/plain", strings.NewReader(file)); code != 403 {
+			t.Error("POST: HTTP", code)
+		}
+	})
+	t.Run("upload without certificate (fail)", func(t *testing.T) {
+		if code := doPOSTFail(t, clientWith(nil, nil), tsURL+"/filedrop", "text/plain", strings.NewReader(file)); code != 403 {
+			t.Error("POST: HTTP", code)
+		}
+	})
+	t.Run("download without certificate", func(t *testing.T) {
+		if url == "" {
+			t.SkipNow()
+		}
+		if body := doGET(t, clientWith(nil, nil), url); string(body) != file {
+			t.Error("Got different file!")
+		}
+	})
+}
+
+func TestTLSCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filedrop-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey, _, _ := genCert(t, "Test CA", nil, nil)
+	first, _, firstPEM, firstKeyPEM := genCert(t, "127.0.0.1", ca, caKey)
+	second, _, secondPEM, secondKeyPEM := genCert(t, "127.0.0.1", ca, caKey)
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certPath, firstPEM, 0600)
+	ioutil.WriteFile(keyPath, firstKeyPEM, 0600)
+
+	tlsConf, err := filedrop.TLSConfig{CertFile: certPath, KeyFile: keyPath}.ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConf.MinVersion != tls.VersionTLS12 {
+		t.Error("Default minimal version is not TLS 1.2")
+	}
+
+	cert, err := tlsConf.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cert.Certificate[0]) != string(first.Raw) {
+		t.Fatal("Wrong initial certificate")
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	ioutil.WriteFile(certPath, secondPEM, 0600)
+	ioutil.WriteFile(keyPath, secondKeyPEM, 0600)
+	// Make sure mtime differs even on filesystems with coarse timestamps.
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, future, future)
+	os.Chtimes(keyPath, future, future)
+
+	cert, err = tlsConf.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cert.Certificate[0]) != string(second.Raw) {
+		t.Fatal("Certificate was not reloaded")
+	}
+}
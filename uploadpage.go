@@ -0,0 +1,98 @@
+package filedrop
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const uploadPageTemplate = "upload.html"
+
+// pageOption is a value for select element in page.
+type pageOption struct {
+	Value string
+	Label string
+}
+
+// uploadPageData is passed to upload page template.
+type uploadPageData struct {
+	// MaxFileSize is LimitsConfig.MaxFileSize, 0 if unlimited.
+	MaxFileSize     uint
+	MaxFileSizeText string
+
+	// Values for max-uses and store-secs parameters allowed by
+	// LimitsConfig. First option is the default one, its value is empty.
+	UsesOptions  []pageOption
+	StoreOptions []pageOption
+
+	// Paste is true if paste mode is enabled.
+	Paste bool
+	// Slugs is true if uploader can choose file ID.
+	Slugs bool
+
+	// AssetsPath is a relative URL of static assets directory.
+	AssetsPath string
+}
+
+var (
+	usesChoices  = []uint{1, 2, 3, 5, 10, 25, 100}
+	storeChoices = []uint{10 * 60, 60 * 60, 24 * 60 * 60, 7 * 24 * 60 * 60, 30 * 24 * 60 * 60}
+)
+
+func uploadPageOptions(limits LimitsConfig) uploadPageData {
+	data := uploadPageData{MaxFileSize: limits.MaxFileSize}
+	if limits.MaxFileSize != 0 {
+		data.MaxFileSizeText = formatSize(uint64(limits.MaxFileSize))
+	}
+
+	if limits.MaxUses == 0 {
+		data.UsesOptions = append(data.UsesOptions, pageOption{"", "Unlimited"})
+	} else {
+		data.UsesOptions = append(data.UsesOptions, pageOption{"", strconv.FormatUint(uint64(limits.MaxUses), 10) + " (maximum)"})
+	}
+	for _, uses := range usesChoices {
+		if limits.MaxUses != 0 && uses >= limits.MaxUses {
+			break
+		}
+		value := strconv.FormatUint(uint64(uses), 10)
+		data.UsesOptions = append(data.UsesOptions, pageOption{value, value})
+	}
+
+	if limits.MaxStoreSecs == 0 {
+		data.StoreOptions = append(data.StoreOptions, pageOption{"", "Forever"})
+	} else {
+		data.StoreOptions = append(data.StoreOptions, pageOption{"", formatSecs(limits.MaxStoreSecs) + " (maximum)"})
+	}
+	for _, secs := range storeChoices {
+		if limits.MaxStoreSecs != 0 && secs >= limits.MaxStoreSecs {
+			break
+		}
+		data.StoreOptions = append(data.StoreOptions, pageOption{strconv.FormatUint(uint64(secs), 10), formatSecs(secs)})
+	}
+	return data
+}
+
+// isUploadPageRequest checks whether browser requests upload endpoint
+// (URL without file ID). Links with UUID of removed file are not
+// considered to be upload endpoint, but there is no way to tell that
+// for shorter IDs.
+func (s *Server) isUploadPageRequest(r *http.Request) bool {
+	if !isBrowserNavigation(r) || hasUUIDComponent(r.URL.Path) {
+		return false
+	}
+	_, _, err := s.resolveFilePath(r.URL.Path)
+	return err == ErrFileDoesntExists
+}
+
+func (s *Server) serveUploadPage(w http.ResponseWriter, r *http.Request) {
+	if !s.Conf.UploadAuth.Allowed(r) {
+		s.Logger.Printf("Authentication failure (URL %v, IP %v)", r.URL.String(), r.RemoteAddr)
+		s.writeErr(w, r, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	data := uploadPageOptions(s.Conf.Limits)
+	data.Paste = s.Conf.Paste.Enabled
+	data.Slugs = s.Conf.IDs.Slugs
+	data.AssetsPath = assetsPath(r.URL.Path)
+	s.renderPage(w, r, s.uploadPage, data)
+}
@@ -0,0 +1,172 @@
+package filedrop_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/filedrop"
+)
+
+func TestUploadPage(t *testing.T) {
+	conf := filedrop.Default
+	conf.UploadPage = true
+	conf.Limits.MaxUses = 5
+	conf.Limits.MaxStoreSecs = 24 * 60 * 60
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	t.Run("page", func(t *testing.T) {
+		resp := getHTML(t, c, ts.URL+"/filedrop")
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("GET: HTTP", resp.StatusCode, resp.Status)
+		}
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+			t.Fatal("Wrong Content-Type:", resp.Header.Get("Content-Type"))
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := string(body)
+		for _, s := range []string{`<option value="">5 (maximum)</option>`, `<option value="3">3</option>`, `<option value="">1 day (maximum)</option>`, `<option value="3600">1 hour</option>`, `src=".assets/upload.js"`} {
+			if !strings.Contains(page, s) {
+				t.Error("Page doesn't contain", s)
+			}
+		}
+		for _, s := range []string{`value="10"`, `Unlimited`, `value="604800"`, `Forever`} {
+			if strings.Contains(page, s) {
+				t.Error("Page contains option not allowed by limits:", s)
+			}
+		}
+	})
+	t.Run("asset", func(t *testing.T) {
+		resp, body := getWithHeader(t, c, ts.URL+"/.assets/upload.js", "Accept", "*/*")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("GET: HTTP", resp.StatusCode, resp.Status)
+		}
+		if !strings.Contains(resp.Header.Get("Content-Type"), "javascript") {
+			t.Error("Wrong Content-Type:", resp.Header.Get("Content-Type"))
+		}
+		if !strings.Contains(string(body), "XMLHttpRequest") {
+			t.Error("Wrong asset contents")
+		}
+	})
+	t.Run("missing asset", func(t *testing.T) {
+		code := doGETFail(t, c, ts.URL+"/.assets/../server.go")
+		if code != http.StatusNotFound {
+			t.Error("GET: HTTP", code)
+		}
+	})
+	t.Run("asset query on download link", func(t *testing.T) {
+		url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+		if body := doGET(t, c, url+"?asset=upload.js"); string(body) != file {
+			t.Error("Got asset instead of file")
+		}
+	})
+	t.Run("non-browser request", func(t *testing.T) {
+		code := doGETFail(t, c, ts.URL+"/filedrop")
+		if code != http.StatusNotFound {
+			t.Error("GET: HTTP", code)
+		}
+	})
+	t.Run("selected max-uses", func(t *testing.T) {
+		// upload.js adds selected options to query.
+		url := string(doPOST(t, c, ts.URL+"/filedrop?max-uses=1", "text/plain", strings.NewReader(file)))
+		if body := doGET(t, c, url); string(body) != file {
+			t.Error("Got different file!")
+		}
+		if code := doGETFail(t, c, url); code != http.StatusNotFound {
+			t.Error("GET after last use: HTTP", code)
+		}
+	})
+	t.Run("files are still served", func(t *testing.T) {
+		url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+		resp := getHTML(t, c, url)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != file {
+			t.Error("Got different file!")
+		}
+	})
+}
+
+func TestUploadPageDisabled(t *testing.T) {
+	serv := initServ(filedrop.Default)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	resp := getHTML(t, c, ts.URL+"/filedrop")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("GET: HTTP", resp.StatusCode, resp.Status)
+	}
+}
+
+func TestUploadPageAuth(t *testing.T) {
+	conf := filedrop.Default
+	conf.UploadPage = true
+	conf.UploadAuth.Callback = authCallback
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	resp := getHTML(t, c, ts.URL+"/filedrop")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("GET: HTTP", resp.StatusCode, resp.Status)
+	}
+}
+
+func TestUploadPageOverride(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "upload.html"), []byte(`<p>Custom {{len .UsesOptions}}</p>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "upload.css"), []byte(`p { color: red; }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := filedrop.Default
+	conf.UploadPage = true
+	conf.WebDir = dir
+	conf.Limits.MaxUses = 2
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	resp := getHTML(t, c, ts.URL+"/filedrop")
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `<p>Custom 2</p>` {
+		t.Error("Template not overridden:", string(body))
+	}
+
+	_, css := getWithHeader(t, c, ts.URL+"/.assets/upload.css", "Accept", "*/*")
+	if string(css) != `p { color: red; }` {
+		t.Error("Asset not overridden:", string(css))
+	}
+	_, js := getWithHeader(t, c, ts.URL+"/.assets/upload.js", "Accept", "*/*")
+	if !strings.Contains(string(js), "XMLHttpRequest") {
+		t.Error("Built-in asset is not used")
+	}
+}
@@ -0,0 +1,270 @@
+package filedrop
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Policies for counting downloads as uses, see LimitsConfig.UsePolicy.
+// HEAD and OPTIONS requests are never counted.
+const (
+	// UsePolicyDelivered counts download once full body is sent to the
+	// client. Range requests are counted once ranges requested during
+	// single download session cover the whole file.
+	//
+	// Note that this policy doesn't enforce max-uses strictly: concurrent
+	// downloads can exceed it since use is counted only at the end of
+	// download, and client can avoid counting by requesting parts of file
+	// in different sessions (like with different User-Agents).
+	UsePolicyDelivered = "delivered"
+
+	// UsePolicySession counts first GET request of each download session,
+	// further requests in the same session (range requests made by
+	// download managers, resumed downloads) are not counted.
+	UsePolicySession = "session"
+
+	// UsePolicyRequest counts each GET request, even if it is a partial
+	// or incomplete download. It is the default.
+	UsePolicyRequest = "request"
+)
+
+func validUsePolicy(policy string) error {
+	switch policy {
+	case UsePolicyDelivered, UsePolicySession, UsePolicyRequest:
+		return nil
+	default:
+		return errors.New("unknown use policy: " + policy)
+	}
+}
+
+// byteRange is a half-open interval of file bytes.
+type byteRange struct {
+	start, end int64
+}
+
+// parseRanges parses Range header value. Unsatisfiable ranges are
+// skipped, nil is returned for malformed header.
+func parseRanges(header string, size int64) []byteRange {
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil
+	}
+	var res []byteRange
+	for _, spec := range strings.Split(header[len("bytes="):], ",") {
+		spec = strings.TrimSpace(spec)
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil
+		}
+		startStr, endStr := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		if startStr == "" {
+			// Suffix range, last N bytes.
+			n, err := strconv.ParseInt(endStr, 10, 64)
+			if err != nil || n < 0 {
+				return nil
+			}
+			if n > size {
+				n = size
+			}
+			res = append(res, byteRange{size - n, size})
+			continue
+		}
+
+		start, err := strconv.ParseInt(startStr, 10, 64)
+		if err != nil || start < 0 {
+			return nil
+		}
+		if start >= size {
+			continue
+		}
+		end := size
+		if endStr != "" {
+			last, err := strconv.ParseInt(endStr, 10, 64)
+			if err != nil || last < start {
+				return nil
+			}
+			if last+1 < size {
+				end = last + 1
+			}
+		}
+		res = append(res, byteRange{start, end})
+	}
+	return res
+}
+
+type downloadSession struct {
+	lastSeen  time.Time
+	delivered []byteRange
+}
+
+// downloadSessions tracks downloads made by clients to count them
+// according to use policy. Session is identified by file, client IP and
+// User-Agent and lasts for LimitsConfig.UseSessionSecs since last request.
+type downloadSessions struct {
+	lock     sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*downloadSession
+}
+
+func newDownloadSessions(ttl time.Duration) *downloadSessions {
+	return &downloadSessions{
+		ttl:      ttl,
+		sessions: make(map[string]*downloadSession),
+	}
+}
+
+func (s *Server) sessionKey(r *http.Request, fileUUID string) string {
+	return fileUUID + "\x00" + s.clientIP(r) + "\x00" + r.UserAgent()
+}
+
+func (ds *downloadSessions) get(key string, now time.Time) (sess *downloadSession, created bool) {
+	sess, ok := ds.sessions[key]
+	if !ok || now.Sub(sess.lastSeen) > ds.ttl {
+		sess = &downloadSession{}
+		ds.sessions[key] = sess
+		created = true
+	}
+	sess.lastSeen = now
+	return sess, created
+}
+
+// begin records request in session and returns true if it started new
+// session.
+func (ds *downloadSessions) begin(key string, now time.Time) bool {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	_, created := ds.get(key, now)
+	return created
+}
+
+// deliver records delivered ranges in session and returns true if the
+// whole file was delivered during session. Session is finished then.
+func (ds *downloadSessions) deliver(key string, ranges []byteRange, size int64, now time.Time) bool {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	sess, _ := ds.get(key, now)
+	delivered := append(sess.delivered, ranges...)
+	sort.Slice(delivered, func(i, j int) bool {
+		return delivered[i].start < delivered[j].start
+	})
+	merged := delivered[:0]
+	for _, r := range delivered {
+		if len(merged) != 0 && r.start <= merged[len(merged)-1].end {
+			if r.end > merged[len(merged)-1].end {
+				merged[len(merged)-1].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	sess.delivered = merged
+
+	if len(merged) == 1 && merged[0].start == 0 && merged[0].end >= size {
+		delete(ds.sessions, key)
+		return true
+	}
+	return false
+}
+
+// prune removes expired sessions.
+func (ds *downloadSessions) prune(now time.Time) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	for key, sess := range ds.sessions {
+		if now.Sub(sess.lastSeen) > ds.ttl {
+			delete(ds.sessions, key)
+		}
+	}
+}
+
+// deliveryWriter calls onComplete with response status just before the
+// last part of response body is written, so use is counted before client
+// gets whole file.
+//
+// If body length is not known, onComplete is called by finish if there
+// were no write errors.
+type deliveryWriter struct {
+	http.ResponseWriter
+	size       int64
+	onComplete func(status int)
+
+	status   int
+	expected int64
+	written  int64
+	done     bool
+	err      error
+}
+
+func (dw *deliveryWriter) WriteHeader(code int) {
+	dw.status = code
+	dw.expected = -1
+	if length, err := strconv.ParseInt(dw.Header().Get("Content-Length"), 10, 64); err == nil {
+		dw.expected = length
+	} else if code == http.StatusOK {
+		// Content-Length is not set by http.ServeContent if
+		// Content-Encoding is used.
+		dw.expected = dw.size
+	}
+	dw.ResponseWriter.WriteHeader(code)
+}
+
+func (dw *deliveryWriter) Write(b []byte) (int, error) {
+	if dw.status == 0 {
+		dw.WriteHeader(http.StatusOK)
+	}
+	if !dw.done && dw.err == nil && dw.expected >= 0 && dw.written+int64(len(b)) >= dw.expected {
+		dw.done = true
+		dw.onComplete(dw.status)
+	}
+	n, err := dw.ResponseWriter.Write(b)
+	dw.written += int64(n)
+	if err != nil {
+		dw.err = err
+	}
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to access underlying writer.
+func (dw *deliveryWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
+
+func (dw *deliveryWriter) finish() {
+	if !dw.done && dw.err == nil && dw.status != 0 {
+		dw.done = true
+		dw.onComplete(dw.status)
+	}
+}
+
+// trackDelivery returns http.ResponseWriter that counts use of file
+// according to UsePolicyDelivered. finish should be called after response
+// is written.
+func (s *Server) trackDelivery(w http.ResponseWriter, r *http.Request, fileUUID string, size int64) *deliveryWriter {
+	return &deliveryWriter{
+		ResponseWriter: w,
+		size:           size,
+		onComplete: func(status int) {
+			switch status {
+			case http.StatusOK:
+			case http.StatusPartialContent:
+				ranges := parseRanges(r.Header.Get("Range"), size)
+				if !s.downloads.deliver(s.sessionKey(r, fileUUID), ranges, size, time.Now()) {
+					return
+				}
+			default:
+				return
+			}
+			if err := s.countUse(fileUUID); err != nil {
+				s.Logger.Printf("Failed to count use (URL %v, IP %v): %v", r.URL.String(), r.RemoteAddr, err)
+			}
+		},
+	}
+}
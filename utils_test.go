@@ -51,6 +51,15 @@ func cleanServ(serv *filedrop.Server) {
 	if _, err := serv.DB.Exec(`DROP TABLE filedrop`); err != nil {
 		panic(err)
 	}
+	if _, err := serv.DB.Exec(`DROP TABLE filedrop_outbox`); err != nil {
+		panic(err)
+	}
+	if _, err := serv.DB.Exec(`DROP TABLE filedrop_blobs`); err != nil {
+		panic(err)
+	}
+	if _, err := serv.DB.Exec(`DROP TABLE filedrop_schema_version`); err != nil {
+		panic(err)
+	}
 	serv.Close()
 	os.Remove(serv.Conf.StorageDir)
 }
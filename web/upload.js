@@ -0,0 +1,118 @@
+'use strict';
+
+(() => {
+	const maxFileSize = Number(document.body.dataset.maxFileSize) || 0;
+	const drop = document.getElementById('drop');
+	const list = document.getElementById('uploads');
+
+	function formatSize(n) {
+		const units = ['B', 'KiB', 'MiB', 'GiB', 'TiB'];
+		let i = 0;
+		while (n >= 1024 && i < units.length - 1) {
+			n /= 1024;
+			i++;
+		}
+		return (i === 0 ? n : n.toFixed(1)) + ' ' + units[i];
+	}
+
+	async function copy(input, button) {
+		try {
+			await navigator.clipboard.writeText(input.value);
+		} catch (e) {
+			// Clipboard API is not available over plain HTTP.
+			input.select();
+			document.execCommand('copy');
+		}
+		button.textContent = 'Copied';
+		setTimeout(() => { button.textContent = 'Copy'; }, 2000);
+	}
+
+	function showLink(item, url) {
+		const box = document.createElement('div');
+		box.className = 'link';
+		const input = document.createElement('input');
+		input.readOnly = true;
+		input.value = url;
+		input.addEventListener('focus', () => input.select());
+		const button = document.createElement('button');
+		button.type = 'button';
+		button.textContent = 'Copy';
+		button.addEventListener('click', () => copy(input, button));
+		box.append(input, button);
+		item.append(box);
+	}
+
+	function upload(file) {
+		const item = document.createElement('li');
+		const name = document.createElement('span');
+		name.className = 'name';
+		name.textContent = file.name + ' (' + formatSize(file.size) + ')';
+		const progress = document.createElement('progress');
+		progress.max = 1;
+		progress.value = 0;
+		const status = document.createElement('span');
+		status.className = 'status';
+		item.append(name, progress, status);
+		list.prepend(item);
+
+		const fail = text => {
+			item.classList.add('failed');
+			progress.remove();
+			status.textContent = text;
+		};
+		if (maxFileSize && file.size > maxFileSize) {
+			fail('File is too big, limit is ' + formatSize(maxFileSize));
+			return;
+		}
+
+		const params = new URLSearchParams();
+		for (const id of ['max-uses', 'store-secs']) {
+			const value = document.getElementById(id).value;
+			if (value) {
+				params.set(id, value);
+			}
+		}
+		let target = location.pathname;
+		if (params.toString()) {
+			target += '?' + params;
+		}
+
+		const xhr = new XMLHttpRequest();
+		xhr.open('POST', target);
+		xhr.upload.addEventListener('progress', ev => {
+			if (ev.lengthComputable) {
+				progress.value = ev.loaded / ev.total;
+			}
+		});
+		xhr.addEventListener('load', () => {
+			if (xhr.status !== 201) {
+				fail('Upload failed: ' + xhr.responseText);
+				return;
+			}
+			progress.remove();
+			showLink(item, xhr.responseText + '/' + encodeURIComponent(file.name));
+		});
+		xhr.addEventListener('error', () => fail('Upload failed: network error'));
+		xhr.send(file);
+	}
+
+	document.getElementById('files').addEventListener('change', ev => {
+		Array.from(ev.target.files).forEach(upload);
+		ev.target.value = '';
+	});
+
+	// Prevent browser from opening files dropped outside of drop zone.
+	document.addEventListener('dragover', ev => ev.preventDefault());
+	document.addEventListener('drop', ev => ev.preventDefault());
+
+	drop.addEventListener('dragover', ev => {
+		ev.preventDefault();
+		drop.classList.add('over');
+	});
+	drop.addEventListener('dragleave', () => drop.classList.remove('over'));
+	drop.addEventListener('drop', ev => {
+		ev.preventDefault();
+		drop.classList.remove('over');
+		Array.from(ev.dataTransfer.files).forEach(upload);
+	});
+})();
@@ -0,0 +1,220 @@
+package filedrop
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// Max delay between delivery attempts.
+const maxWebhookBackoff = time.Hour
+
+// webhookSink delivers events to configured URLs.
+//
+// Events are first saved to outbox table in DB and then delivered by
+// separate goroutine so they survive server restarts and temporary
+// receiver failures.
+type webhookSink struct {
+	s     *Server
+	hooks map[string]WebhookConfig
+	http  *http.Client
+
+	wake     chan struct{}
+	stopChan chan bool
+}
+
+func newWebhookSink(s *Server, hooks []WebhookConfig) *webhookSink {
+	sink := &webhookSink{
+		s:        s,
+		hooks:    make(map[string]WebhookConfig, len(hooks)),
+		http:     &http.Client{},
+		wake:     make(chan struct{}, 1),
+		stopChan: make(chan bool),
+	}
+	for _, hook := range hooks {
+		if hook.MaxAttempts == 0 {
+			hook.MaxAttempts = 10
+		}
+		if hook.TimeoutSecs == 0 {
+			hook.TimeoutSecs = 10
+		}
+		sink.hooks[hook.URL] = hook
+	}
+	go sink.deliveryLoop()
+	return sink
+}
+
+// validateWebhooks checks list of webhooks. Events in outbox are
+// associated with webhook by URL, so URLs must be unique.
+func validateWebhooks(hooks []WebhookConfig) error {
+	seen := make(map[string]bool, len(hooks))
+	for _, hook := range hooks {
+		if hook.URL == "" {
+			return errors.New("webhooks: url is required")
+		}
+		if seen[hook.URL] {
+			return errors.New("webhooks: duplicate url: " + hook.URL)
+		}
+		seen[hook.URL] = true
+	}
+	return nil
+}
+
+func (hook WebhookConfig) wants(evType EventType) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, t := range hook.Events {
+		if t == evType {
+			return true
+		}
+	}
+	return false
+}
+
+type webhookPayload struct {
+	ID string `json:"id"`
+	Event
+}
+
+func (w *webhookSink) Publish(ev Event) {
+	for target, hook := range w.hooks {
+		if !hook.wants(ev.Type) {
+			continue
+		}
+
+		id, err := uuid.NewV4()
+		if err != nil {
+			w.s.Logger.Println("Webhook: UUID generation failed:", err)
+			return
+		}
+		payload, err := json.Marshal(webhookPayload{ID: id.String(), Event: ev})
+		if err != nil {
+			w.s.Logger.Println("Webhook: payload serialization failed:", err)
+			return
+		}
+		err = retryQuery(func() error {
+			return w.s.DB.AddOutbox(id.String(), target, payload)
+		})
+		if err != nil {
+			w.s.Logger.Printf("Webhook: failed to save event %v for %v: %v\n", ev.Type, target, err)
+		}
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *webhookSink) Close() error {
+	w.stopChan <- true
+	<-w.stopChan
+	return nil
+}
+
+func (w *webhookSink) deliveryLoop() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	// Deliver events left from previous run.
+	w.deliverPending()
+	for {
+		select {
+		case <-w.stopChan:
+			w.stopChan <- true
+			return
+		case <-tick.C:
+		case <-w.wake:
+		}
+		w.deliverPending()
+	}
+}
+
+func (w *webhookSink) deliverPending() {
+	entries, err := w.s.DB.PendingOutbox(time.Now())
+	if err != nil {
+		w.s.Logger.Println("Webhook: failed to get pending events:", err)
+		return
+	}
+
+	for _, entry := range entries {
+		hook, ok := w.hooks[entry.Target]
+		if !ok {
+			w.s.dbgLog("Webhook: dropping event", entry.ID, "for removed target", entry.Target)
+			if err := w.s.DB.RemoveOutbox(entry.ID); err != nil {
+				w.s.Logger.Println("Webhook: outbox remove failed:", err)
+			}
+			continue
+		}
+
+		err := w.deliver(hook, entry)
+		if err == nil {
+			w.s.dbgLog("Webhook: delivered event", entry.ID, "to", entry.Target)
+			if err := w.s.DB.RemoveOutbox(entry.ID); err != nil {
+				w.s.Logger.Println("Webhook: outbox remove failed:", err)
+			}
+			continue
+		}
+
+		attempts := entry.Attempts + 1
+		if attempts >= hook.MaxAttempts {
+			w.s.Logger.Printf("Webhook: giving up on event %v for %v after %d attempts: %v\n", entry.ID, entry.Target, attempts, err)
+			if err := w.s.DB.RemoveOutbox(entry.ID); err != nil {
+				w.s.Logger.Println("Webhook: outbox remove failed:", err)
+			}
+			continue
+		}
+
+		backoff := time.Second << uint(entry.Attempts)
+		if backoff > maxWebhookBackoff || backoff <= 0 {
+			backoff = maxWebhookBackoff
+		}
+		w.s.dbgLog("Webhook: delivery of", entry.ID, "to", entry.Target, "failed, retry in", backoff, "-", err)
+		if err := w.s.DB.RetryOutbox(entry.ID, attempts, time.Now().Add(backoff)); err != nil {
+			w.s.Logger.Println("Webhook: outbox update failed:", err)
+		}
+	}
+}
+
+// signPayload computes value of X-Filedrop-Signature header.
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *webhookSink) deliver(hook WebhookConfig, entry outboxEntry) error {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(entry.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Filedrop-Delivery", entry.ID)
+	if hook.Secret != "" {
+		req.Header.Set("X-Filedrop-Signature", signPayload(hook.Secret, entry.Payload))
+	}
+
+	client := *w.http
+	client.Timeout = time.Duration(hook.TimeoutSecs) * time.Second
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return errors.New("HTTP " + resp.Status)
+	}
+	return nil
+}
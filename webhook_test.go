@@ -0,0 +1,189 @@
+package filedrop_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/filedrop"
+)
+
+type webhookReceiver struct {
+	t      *testing.T
+	secret string
+
+	lock   sync.Mutex
+	fail   int
+	events []filedrop.EventType
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+
+	if wr.fail > 0 {
+		wr.fail--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		wr.t.Error("ioutil.ReadAll:", err)
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(wr.secret))
+	mac.Write(body)
+	if r.Header.Get("X-Filedrop-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		wr.t.Error("Invalid signature:", r.Header.Get("X-Filedrop-Signature"))
+	}
+
+	ev := filedrop.Event{}
+	if err := json.Unmarshal(body, &ev); err != nil {
+		wr.t.Error("JSON decode:", err)
+		return
+	}
+	wr.events = append(wr.events, ev.Type)
+}
+
+func (wr *webhookReceiver) waitFor(t *testing.T, count int, timeout time.Duration) []filedrop.EventType {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		wr.lock.Lock()
+		if len(wr.events) >= count {
+			res := append([]filedrop.EventType{}, wr.events...)
+			wr.lock.Unlock()
+			return res
+		}
+		wr.lock.Unlock()
+		time.Sleep(100 * time.Millisecond)
+	}
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+	t.Fatalf("Timed out waiting for %d events, got %v", count, wr.events)
+	return nil
+}
+
+func TestWebhookLifecycle(t *testing.T) {
+	receiver := &webhookReceiver{t: t, secret: "meow"}
+	hookServ := httptest.NewServer(receiver)
+	defer hookServ.Close()
+
+	conf := filedrop.Default
+	conf.Limits.MaxUses = 1
+	conf.Webhooks = []filedrop.WebhookConfig{{URL: hookServ.URL, Secret: "meow"}}
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	doGET(t, c, url)
+	doGETFail(t, c, url)
+
+	events := receiver.waitFor(t, 4, 5*time.Second)
+	expected := []filedrop.EventType{filedrop.EventUploaded, filedrop.EventDownloaded, filedrop.EventExhausted, filedrop.EventDeleted}
+	for _, ev := range expected {
+		found := false
+		for _, got := range events {
+			if got == ev {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Missing %v event, got %v", ev, events)
+		}
+	}
+}
+
+func TestWebhookEventFilterAndRetry(t *testing.T) {
+	receiver := &webhookReceiver{t: t, secret: "meow", fail: 2}
+	hookServ := httptest.NewServer(receiver)
+	defer hookServ.Close()
+
+	conf := filedrop.Default
+	conf.Webhooks = []filedrop.WebhookConfig{{
+		URL:    hookServ.URL,
+		Secret: "meow",
+		Events: []filedrop.EventType{filedrop.EventDownloaded},
+	}}
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	defer cleanServ(serv)
+	defer ts.Close()
+	c := ts.Client()
+
+	url := string(doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file)))
+	doGET(t, c, url)
+
+	events := receiver.waitFor(t, 1, 8*time.Second)
+	if len(events) != 1 || events[0] != filedrop.EventDownloaded {
+		t.Error("Unexpected events:", events)
+	}
+}
+
+func TestWebhookOutboxPersisted(t *testing.T) {
+	if TestDSN == ":memory:" {
+		t.Skip("Can't reopen in-memory DB")
+	}
+
+	receiver := &webhookReceiver{t: t, secret: "meow"}
+	hookServ := httptest.NewUnstartedServer(receiver)
+
+	conf := filedrop.Default
+	conf.Webhooks = []filedrop.WebhookConfig{{URL: "http://" + hookServ.Listener.Addr().String(), Secret: "meow", TimeoutSecs: 1}}
+	serv := initServ(conf)
+	ts := httptest.NewServer(serv)
+	c := ts.Client()
+
+	// Receiver is not running yet so delivery fails.
+	doPOST(t, c, ts.URL+"/filedrop", "text/plain", strings.NewReader(file))
+	ts.Close()
+	if err := serv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	hookServ.Start()
+	defer hookServ.Close()
+
+	conf.StorageDir = serv.Conf.StorageDir
+	conf.DB = serv.Conf.DB
+	serv, err := filedrop.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanServ(serv)
+
+	events := receiver.waitFor(t, 1, 5*time.Second)
+	if events[0] != filedrop.EventUploaded {
+		t.Error("Unexpected events:", events)
+	}
+}
+
+func TestWebhooksConfigInvalid(t *testing.T) {
+	cases := [][]filedrop.WebhookConfig{
+		{{URL: ""}},
+		{
+			{URL: "http://example.org/hook", Events: []filedrop.EventType{filedrop.EventUploaded}},
+			{URL: "http://example.org/hook", Events: []filedrop.EventType{filedrop.EventDeleted}, Secret: "meow"},
+		},
+	}
+	for _, hooks := range cases {
+		conf := filedrop.Default
+		conf.Webhooks = hooks
+		if _, err := filedrop.New(conf); err == nil {
+			t.Error("No error for", hooks)
+		}
+	}
+}